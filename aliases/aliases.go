@@ -0,0 +1,181 @@
+package aliases
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/opaas/capacity-worker/metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+// Table maps the site, datacenter and pod codes vCenter reports to the ones
+// OPaaS uses. Codes are matched exactly. KnownSites lists sites that are
+// valid as reported even if OPaaS has nothing there yet.
+type Table struct {
+	Sites       map[string]string `json:"sites" yaml:"sites"`
+	Datacenters map[string]string `json:"datacenters" yaml:"datacenters"`
+	Pods        map[string]string `json:"pods" yaml:"pods"`
+	KnownSites  []string          `json:"knownSites" yaml:"knownSites"`
+}
+
+var (
+	mutex         sync.Mutex
+	current       = builtinTable()
+	reportedSites = make(map[string]bool)
+)
+
+// builtinTable holds the renames that were hard-coded before the table could
+// be configured, so a worker without a config file behaves as it always did.
+func builtinTable() *Table {
+	return &Table{
+		Sites: map[string]string{
+			"POK1E": "POK02",
+			"DAL1E": "DAL00",
+		},
+		Datacenters: map[string]string{},
+		Pods:        map[string]string{},
+	}
+}
+
+// Load reads the table from a YAML or JSON file, chosen by its extension,
+// and merges it over the built-in one. With watch set the file is reloaded
+// whenever it changes. A reload that fails is logged and the previous table
+// is kept.
+func Load(path string, watch bool) error {
+	table, readErr := read(path)
+	if readErr != nil {
+		return readErr
+	}
+	set(table)
+	if watch {
+		// viper only watches the file; it is parsed here, since viper would
+		// lowercase the codes.
+		config := viper.New()
+		config.SetConfigFile(path)
+		config.OnConfigChange(func(event fsnotify.Event) {
+			reloaded, reloadErr := read(path)
+			if reloadErr != nil {
+				logrus.WithFields(logrus.Fields{
+					"file":  path,
+					"Error": reloadErr.Error(),
+				}).Error("Unable to reload aliases, keeping the previous ones")
+				return
+			}
+			set(reloaded)
+			logrus.WithFields(logrus.Fields{
+				"file": path,
+			}).Info("Reloaded aliases")
+		})
+		config.WatchConfig()
+	}
+	return nil
+}
+
+func read(path string) (*Table, error) {
+	data, readErr := ioutil.ReadFile(path)
+	if readErr != nil {
+		return nil, fmt.Errorf("Unable to read aliases: %w", readErr)
+	}
+	loaded := &Table{}
+	var unmarshalErr error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		unmarshalErr = json.Unmarshal(data, loaded)
+	case ".yaml", ".yml":
+		unmarshalErr = yaml.Unmarshal(data, loaded)
+	default:
+		return nil, fmt.Errorf("Unable to read aliases: unsupported file type %q", filepath.Ext(path))
+	}
+	if unmarshalErr != nil {
+		return nil, fmt.Errorf("Unable to parse aliases: %w", unmarshalErr)
+	}
+	return merge(builtinTable(), loaded), nil
+}
+
+// merge adds the codes in loaded to table, replacing the ones both have.
+func merge(table *Table, loaded *Table) *Table {
+	for code, alias := range loaded.Sites {
+		table.Sites[code] = alias
+	}
+	for code, alias := range loaded.Datacenters {
+		table.Datacenters[code] = alias
+	}
+	for code, alias := range loaded.Pods {
+		table.Pods[code] = alias
+	}
+	table.KnownSites = append(table.KnownSites, loaded.KnownSites...)
+	return table
+}
+
+func set(table *Table) {
+	mutex.Lock()
+	current = table
+	mutex.Unlock()
+}
+
+func table() *Table {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return current
+}
+
+// Site returns the OPaaS code for a vCenter site, or the site itself when it
+// has no alias.
+func Site(site string) string {
+	return lookup(table().Sites, site)
+}
+
+func Datacenter(datacenter string) string {
+	return lookup(table().Datacenters, datacenter)
+}
+
+func Pod(pod string) string {
+	return lookup(table().Pods, pod)
+}
+
+func lookup(aliases map[string]string, code string) string {
+	if alias, found := aliases[code]; found {
+		return alias
+	}
+	return code
+}
+
+// IsKnownSite reports whether site is an alias target or listed in
+// knownSites.
+func IsKnownSite(site string) bool {
+	aliases := table()
+	for _, known := range aliases.KnownSites {
+		if known == site {
+			return true
+		}
+	}
+	for _, alias := range aliases.Sites {
+		if alias == site {
+			return true
+		}
+	}
+	return false
+}
+
+// ReportUnknownSite counts a record from a site nothing maps to. Each site is
+// logged the first time it is seen.
+func ReportUnknownSite(site string) {
+	metrics.UnknownSites.WithLabelValues(site).Inc()
+	mutex.Lock()
+	alreadyReported := reportedSites[site]
+	reportedSites[site] = true
+	mutex.Unlock()
+	if alreadyReported {
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"site": site,
+	}).Warn("Unknown site, add it to the aliases or knownSites")
+}
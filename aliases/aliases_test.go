@@ -0,0 +1,57 @@
+package aliases
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadMergesOverBuiltinAliases(t *testing.T) {
+	files := map[string]string{
+		"aliases.yaml": "sites:\n  WDC1E: WDC07\ndatacenters:\n  dal10-a: dal10\npods:\n  \"07\": 7\nknownSites: [WDC04]\n",
+		"aliases.json": `{"sites":{"WDC1E":"WDC07"},"datacenters":{"dal10-a":"dal10"},"pods":{"07":"7"},"knownSites":["WDC04"]}`,
+	}
+	tests := []struct {
+		name   string
+		lookup func(string) string
+		code   string
+		want   string
+	}{
+		{name: "site from file", lookup: Site, code: "WDC1E", want: "WDC07"},
+		{name: "builtin site kept", lookup: Site, code: "POK1E", want: "POK02"},
+		{name: "other builtin site kept", lookup: Site, code: "DAL1E", want: "DAL00"},
+		{name: "site matched exactly", lookup: Site, code: "pok1e", want: "pok1e"},
+		{name: "datacenter from file", lookup: Datacenter, code: "dal10-a", want: "dal10"},
+		{name: "datacenter matched exactly", lookup: Datacenter, code: "DAL10-A", want: "DAL10-A"},
+		{name: "pod from file", lookup: Pod, code: "07", want: "7"},
+		{name: "code without alias", lookup: Site, code: "FRA02", want: "FRA02"},
+	}
+	for fileName, contents := range files {
+		dir, dirErr := ioutil.TempDir("", "aliases")
+		if dirErr != nil {
+			t.Fatal(dirErr)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, fileName)
+		writeErr := ioutil.WriteFile(path, []byte(contents), 0644)
+		if writeErr != nil {
+			t.Fatal(writeErr)
+		}
+		loadErr := Load(path, false)
+		if loadErr != nil {
+			t.Fatalf("Load(%s) error = %v", fileName, loadErr)
+		}
+		for _, test := range tests {
+			t.Run(fileName+"/"+test.name, func(t *testing.T) {
+				if got := test.lookup(test.code); got != test.want {
+					t.Errorf("lookup(%q) = %q, want %q", test.code, got, test.want)
+				}
+			})
+		}
+		if !IsKnownSite("WDC04") || !IsKnownSite("POK02") {
+			t.Errorf("%s: known sites from the file and builtin alias targets should be known", fileName)
+		}
+	}
+	set(builtinTable())
+}
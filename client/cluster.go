@@ -17,6 +17,11 @@ type Cluster struct {
 	Profile               string   `json:"profile"`
 	ClusterName           string   `json:"clusterName"`
 	WorkloadTypes         []string `json:"workloadTypes"`
+	// HostCores and HostMemoryGB are the physical cores and memory OPaaS
+	// expects of every host in the cluster, as set by its profile. They are
+	// zero when the profile sets none.
+	HostCores    int `json:"hostCores"`
+	HostMemoryGB int `json:"hostMemoryGB"`
 }
 
 func (opaasApi *OpaasApi) GetClusters() ([]Cluster, error) {
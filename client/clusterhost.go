@@ -2,12 +2,17 @@ package client
 
 const clusterhost_endpoint string = "cluster-hosts"
 
+// ClusterhostDecommissioned is the OPaaS status of a clusterhost that was
+// taken out of service. OPaaS leaves status empty for hosts in use.
+const ClusterhostDecommissioned string = "decommissioned"
+
 type Clusterhost struct {
-	ID            string   `json:"id"`
+	ID            string   `json:"id,omitempty"`
 	Name          string   `json:"hostName"`
 	ServerID      string   `json:"serverId"`
 	ClusterID     string   `json:"clusterId"`
 	WorkloadTypes []string `json:"workloadTypes"`
+	Status        string   `json:"status,omitempty"`
 }
 
 func (opaasApi *OpaasApi) GetClusterhosts() ([]Clusterhost, error) {
@@ -19,3 +24,15 @@ func (opaasApi *OpaasApi) GetClusterhosts() ([]Clusterhost, error) {
 	return clusterhostData, nil
 }
 
+func (opaasApi *OpaasApi) CreateClusterhost(clusterhost Clusterhost) (*Clusterhost, error) {
+	createdClusterhost := &Clusterhost{}
+	httpErr := opaasApi.post(clusterhost_endpoint, clusterhost, createdClusterhost)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	return createdClusterhost, nil
+}
+
+func (opaasApi *OpaasApi) PatchClusterhost(clusterhostId string, patches []Patch) error {
+	return opaasApi.patch(clusterhost_endpoint, clusterhostId, patches)
+}
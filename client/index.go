@@ -0,0 +1,161 @@
+package client
+
+type clusterKey struct {
+	site        string
+	datacenter  string
+	clusterName string
+}
+
+type resourcePoolKey struct {
+	site         string
+	pod          int
+	datacenter   string
+	resourcePool string
+}
+
+type clusterhostClusterKey struct {
+	datacenter  string
+	pod         int
+	clusterName string
+}
+
+// opaasIndexes map lookup keys to positions in the OpaasData slices. When
+// several records share a key the first one wins, as it did with the linear
+// scans these replace.
+type opaasIndexes struct {
+	instanceByHostname      map[string]int
+	storageByName           map[string]int
+	clusterByName           map[clusterKey]int
+	clusterByResourcePool   map[resourcePoolKey]int
+	clusterByClusterhostKey map[clusterhostClusterKey]int
+	clustersByStorageID     map[string][]int
+	clusterhostByName       map[string]int
+	sites                   map[string]bool
+}
+
+// NewOpaasData bundles one inventory snapshot and indexes it for lookups.
+func NewOpaasData(instances []Instance, storage []Storage, clusters []Cluster, clusterhosts []Clusterhost) *OpaasData {
+	opaasData := &OpaasData{
+		Instances:    instances,
+		Storage:      storage,
+		Clusters:     clusters,
+		Clusterhosts: clusterhosts,
+	}
+	opaasData.BuildIndexes()
+	return opaasData
+}
+
+// BuildIndexes rebuilds the lookup indexes. It has to be called again if the
+// slices are changed after the first lookup.
+func (opaasData *OpaasData) BuildIndexes() {
+	indexes := &opaasIndexes{
+		instanceByHostname:      make(map[string]int, len(opaasData.Instances)),
+		storageByName:           make(map[string]int, len(opaasData.Storage)),
+		clusterByName:           make(map[clusterKey]int, len(opaasData.Clusters)),
+		clusterByResourcePool:   make(map[resourcePoolKey]int, len(opaasData.Clusters)),
+		clusterByClusterhostKey: make(map[clusterhostClusterKey]int, len(opaasData.Clusters)),
+		clustersByStorageID:     make(map[string][]int),
+		clusterhostByName:       make(map[string]int, len(opaasData.Clusterhosts)),
+		sites:                   make(map[string]bool),
+	}
+	for i, instance := range opaasData.Instances {
+		if _, found := indexes.instanceByHostname[instance.Hostname]; !found {
+			indexes.instanceByHostname[instance.Hostname] = i
+		}
+		indexes.sites[instance.Site] = true
+	}
+	for i, storage := range opaasData.Storage {
+		if _, found := indexes.storageByName[storage.Name]; !found {
+			indexes.storageByName[storage.Name] = i
+		}
+	}
+	for i, cluster := range opaasData.Clusters {
+		indexes.sites[cluster.PoolLocation] = true
+		byName := clusterKey{cluster.PoolLocation, cluster.Datacenter, cluster.ClusterName}
+		if _, found := indexes.clusterByName[byName]; !found {
+			indexes.clusterByName[byName] = i
+		}
+		byResourcePool := resourcePoolKey{cluster.PoolLocation, cluster.Pod, cluster.Datacenter, cluster.ResourcePoolName}
+		if _, found := indexes.clusterByResourcePool[byResourcePool]; !found {
+			indexes.clusterByResourcePool[byResourcePool] = i
+		}
+		byClusterhostKey := clusterhostClusterKey{cluster.Datacenter, cluster.Pod, cluster.ClusterName}
+		if _, found := indexes.clusterByClusterhostKey[byClusterhostKey]; !found {
+			indexes.clusterByClusterhostKey[byClusterhostKey] = i
+		}
+		for _, storageID := range cluster.StorageIds {
+			indexes.clustersByStorageID[storageID] = append(indexes.clustersByStorageID[storageID], i)
+		}
+	}
+	for i, clusterhost := range opaasData.Clusterhosts {
+		if _, found := indexes.clusterhostByName[clusterhost.Name]; !found {
+			indexes.clusterhostByName[clusterhost.Name] = i
+		}
+	}
+	opaasData.indexes = indexes
+}
+
+func (opaasData *OpaasData) indexed() *opaasIndexes {
+	if opaasData.indexes == nil {
+		opaasData.BuildIndexes()
+	}
+	return opaasData.indexes
+}
+
+func (opaasData *OpaasData) InstanceByHostname(hostname string) *Instance {
+	if i, found := opaasData.indexed().instanceByHostname[hostname]; found {
+		return &opaasData.Instances[i]
+	}
+	return nil
+}
+
+func (opaasData *OpaasData) StorageByName(name string) *Storage {
+	if i, found := opaasData.indexed().storageByName[name]; found {
+		return &opaasData.Storage[i]
+	}
+	return nil
+}
+
+func (opaasData *OpaasData) ClusterByName(site string, datacenter string, clusterName string) *Cluster {
+	if i, found := opaasData.indexed().clusterByName[clusterKey{site, datacenter, clusterName}]; found {
+		return &opaasData.Clusters[i]
+	}
+	return nil
+}
+
+func (opaasData *OpaasData) ClusterByResourcePool(site string, pod int, datacenter string, resourcePool string) *Cluster {
+	if i, found := opaasData.indexed().clusterByResourcePool[resourcePoolKey{site, pod, datacenter, resourcePool}]; found {
+		return &opaasData.Clusters[i]
+	}
+	return nil
+}
+
+// ClusterForClusterhost finds the cluster an ESX host belongs to. Host
+// records carry no site, so clusters are keyed by datacenter, pod and name.
+func (opaasData *OpaasData) ClusterForClusterhost(datacenter string, pod int, clusterName string) *Cluster {
+	if i, found := opaasData.indexed().clusterByClusterhostKey[clusterhostClusterKey{datacenter, pod, clusterName}]; found {
+		return &opaasData.Clusters[i]
+	}
+	return nil
+}
+
+func (opaasData *OpaasData) ClustersWithStorage(storageID string) []*Cluster {
+	positions := opaasData.indexed().clustersByStorageID[storageID]
+	clusters := make([]*Cluster, 0, len(positions))
+	for _, i := range positions {
+		clusters = append(clusters, &opaasData.Clusters[i])
+	}
+	return clusters
+}
+
+// HasSite reports whether any instance or cluster is at site.
+func (opaasData *OpaasData) HasSite(site string) bool {
+	return opaasData.indexed().sites[site]
+}
+
+func (opaasData *OpaasData) ClusterhostByName(hostName string) *Clusterhost {
+	if i, found := opaasData.indexed().clusterhostByName[hostName]; found {
+		return &opaasData.Clusterhosts[i]
+	}
+	return nil
+}
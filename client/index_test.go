@@ -0,0 +1,316 @@
+package client
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+const (
+	benchmark_instances = 50000
+	benchmark_clusters  = 2000
+)
+
+func benchmarkInventory() *OpaasData {
+	instances := make([]Instance, benchmark_instances)
+	for i := range instances {
+		instances[i].Hostname = fmt.Sprintf("vm%06d.example.com", i)
+	}
+	clusters := make([]Cluster, benchmark_clusters)
+	for i := range clusters {
+		clusters[i] = Cluster{
+			ID:               fmt.Sprintf("cluster-%d", i),
+			PoolLocation:     fmt.Sprintf("SITE%02d", i%40),
+			Datacenter:       fmt.Sprintf("dc%02d", i%20),
+			Pod:              i % 8,
+			ClusterName:      fmt.Sprintf("esx-cluster-%d", i),
+			ResourcePoolName: fmt.Sprintf("pool-%d", i),
+		}
+	}
+	return NewOpaasData(instances, nil, clusters, nil)
+}
+
+func BenchmarkInstanceLinearScan(b *testing.B) {
+	opaasData := benchmarkInventory()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		hostname := opaasData.Instances[n%benchmark_instances].Hostname
+		for i := range opaasData.Instances {
+			if opaasData.Instances[i].Hostname == hostname {
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkInstanceByHostname(b *testing.B) {
+	opaasData := benchmarkInventory()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if opaasData.InstanceByHostname(opaasData.Instances[n%benchmark_instances].Hostname) == nil {
+			b.Fatal("instance not found")
+		}
+	}
+}
+
+func BenchmarkClusterLinearScan(b *testing.B) {
+	opaasData := benchmarkInventory()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		wanted := opaasData.Clusters[n%benchmark_clusters]
+		for _, cluster := range opaasData.Clusters {
+			if cluster.PoolLocation == wanted.PoolLocation &&
+				cluster.Pod == wanted.Pod &&
+				cluster.Datacenter == wanted.Datacenter &&
+				cluster.ResourcePoolName == wanted.ResourcePoolName {
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkClusterByResourcePool(b *testing.B) {
+	opaasData := benchmarkInventory()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		wanted := opaasData.Clusters[n%benchmark_clusters]
+		if opaasData.ClusterByResourcePool(wanted.PoolLocation, wanted.Pod, wanted.Datacenter, wanted.ResourcePoolName) == nil {
+			b.Fatal("cluster not found")
+		}
+	}
+}
+
+// BenchmarkBuildIndexes is the cost paid once per snapshot.
+func BenchmarkBuildIndexes(b *testing.B) {
+	opaasData := benchmarkInventory()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		opaasData.BuildIndexes()
+	}
+}
+
+// indexFixture repeats every lookup key at least once, so the tests below see
+// which record wins.
+func indexFixture() *OpaasData {
+	instances := []Instance{
+		{Hostname: "vm1.example.com", Site: "POK02"},
+		{Hostname: "vm2.example.com", Site: "POK02"},
+		{Hostname: "vm1.example.com", Site: "DAL00"},
+	}
+	storage := []Storage{
+		{ID: "s1", Name: "ds1"},
+		{ID: "s2", Name: "ds2"},
+		{ID: "s3", Name: "ds1"},
+	}
+	clusters := []Cluster{
+		{ID: "c0", PoolLocation: "POK02", Datacenter: "pok02", Pod: 1, ClusterName: "esx1", ResourcePoolName: "rp1", StorageIds: []string{"s1", "s2"}},
+		{ID: "c1", PoolLocation: "POK02", Datacenter: "pok02", Pod: 2, ClusterName: "esx1", ResourcePoolName: "rp1", StorageIds: []string{"s2"}},
+		{ID: "c2", PoolLocation: "WDC07", Datacenter: "pok02", Pod: 1, ClusterName: "esx1", ResourcePoolName: "rp2"},
+		{ID: "c3", PoolLocation: "POK02", Datacenter: "pok02", Pod: 1, ClusterName: "esx2", ResourcePoolName: "rp1"},
+	}
+	clusterhosts := []Clusterhost{
+		{ID: "h0", Name: "host1.example.com"},
+		{ID: "h1", Name: "host2.example.com"},
+		{ID: "h2", Name: "host1.example.com"},
+	}
+	return NewOpaasData(instances, storage, clusters, clusterhosts)
+}
+
+// The scans below are the lookups the indexes replaced. Each returns the
+// position of the first match, or -1.
+
+func scanInstance(opaasData *OpaasData, hostname string) int {
+	for i, instance := range opaasData.Instances {
+		if instance.Hostname == hostname {
+			return i
+		}
+	}
+	return -1
+}
+
+func scanStorage(opaasData *OpaasData, name string) int {
+	for i, storage := range opaasData.Storage {
+		if storage.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func scanClusterByName(opaasData *OpaasData, site string, datacenter string, clusterName string) int {
+	for i, cluster := range opaasData.Clusters {
+		if cluster.PoolLocation == site && cluster.Datacenter == datacenter && cluster.ClusterName == clusterName {
+			return i
+		}
+	}
+	return -1
+}
+
+func scanClusterByResourcePool(opaasData *OpaasData, site string, pod int, datacenter string, resourcePool string) int {
+	for i, cluster := range opaasData.Clusters {
+		if cluster.PoolLocation == site && cluster.Pod == pod && cluster.Datacenter == datacenter && cluster.ResourcePoolName == resourcePool {
+			return i
+		}
+	}
+	return -1
+}
+
+func scanClusterForClusterhost(opaasData *OpaasData, datacenter string, pod int, clusterName string) int {
+	for i, cluster := range opaasData.Clusters {
+		if cluster.ClusterName == clusterName && cluster.Datacenter == datacenter && cluster.Pod == pod {
+			return i
+		}
+	}
+	return -1
+}
+
+func scanClustersWithStorage(opaasData *OpaasData, storageID string) []string {
+	clusterIDs := []string{}
+	for _, cluster := range opaasData.Clusters {
+		for _, id := range cluster.StorageIds {
+			if id == storageID {
+				clusterIDs = append(clusterIDs, cluster.ID)
+			}
+		}
+	}
+	return clusterIDs
+}
+
+func scanClusterhost(opaasData *OpaasData, hostName string) int {
+	for i, clusterhost := range opaasData.Clusterhosts {
+		if clusterhost.Name == hostName {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestInstanceByHostname(t *testing.T) {
+	opaasData := indexFixture()
+	for _, hostname := range []string{"vm1.example.com", "vm2.example.com", "VM1.example.com", ""} {
+		want := scanInstance(opaasData, hostname)
+		var wantInstance *Instance
+		if want >= 0 {
+			wantInstance = &opaasData.Instances[want]
+		}
+		if got := opaasData.InstanceByHostname(hostname); got != wantInstance {
+			t.Errorf("InstanceByHostname(%q) = %p, want %p (position %d)", hostname, got, wantInstance, want)
+		}
+	}
+}
+
+func TestStorageByName(t *testing.T) {
+	opaasData := indexFixture()
+	for _, name := range []string{"ds1", "ds2", "ds3", ""} {
+		want := scanStorage(opaasData, name)
+		var wantStorage *Storage
+		if want >= 0 {
+			wantStorage = &opaasData.Storage[want]
+		}
+		if got := opaasData.StorageByName(name); got != wantStorage {
+			t.Errorf("StorageByName(%q) = %p, want %p (position %d)", name, got, wantStorage, want)
+		}
+	}
+}
+
+func TestClusterLookups(t *testing.T) {
+	opaasData := indexFixture()
+	tests := []struct {
+		name         string
+		site         string
+		datacenter   string
+		pod          int
+		clusterName  string
+		resourcePool string
+	}{
+		{name: "first of two clusters with the same name", site: "POK02", datacenter: "pok02", pod: 1, clusterName: "esx1", resourcePool: "rp1"},
+		{name: "same name in another pod", site: "POK02", datacenter: "pok02", pod: 2, clusterName: "esx1", resourcePool: "rp1"},
+		{name: "same name at another site", site: "WDC07", datacenter: "pok02", pod: 1, clusterName: "esx1", resourcePool: "rp2"},
+		{name: "other cluster", site: "POK02", datacenter: "pok02", pod: 1, clusterName: "esx2", resourcePool: "rp1"},
+		{name: "unknown pod", site: "POK02", datacenter: "pok02", pod: 7, clusterName: "esx1", resourcePool: "rp1"},
+		{name: "unknown datacenter", site: "POK02", datacenter: "dal10", pod: 1, clusterName: "esx1", resourcePool: "rp1"},
+		{name: "case differs", site: "pok02", datacenter: "POK02", pod: 1, clusterName: "ESX1", resourcePool: "RP1"},
+	}
+	clusterAt := func(i int) *Cluster {
+		if i < 0 {
+			return nil
+		}
+		return &opaasData.Clusters[i]
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			want := clusterAt(scanClusterByName(opaasData, test.site, test.datacenter, test.clusterName))
+			if got := opaasData.ClusterByName(test.site, test.datacenter, test.clusterName); got != want {
+				t.Errorf("ClusterByName() = %p, want %p", got, want)
+			}
+			want = clusterAt(scanClusterByResourcePool(opaasData, test.site, test.pod, test.datacenter, test.resourcePool))
+			if got := opaasData.ClusterByResourcePool(test.site, test.pod, test.datacenter, test.resourcePool); got != want {
+				t.Errorf("ClusterByResourcePool() = %p, want %p", got, want)
+			}
+			want = clusterAt(scanClusterForClusterhost(opaasData, test.datacenter, test.pod, test.clusterName))
+			if got := opaasData.ClusterForClusterhost(test.datacenter, test.pod, test.clusterName); got != want {
+				t.Errorf("ClusterForClusterhost() = %p, want %p", got, want)
+			}
+		})
+	}
+}
+
+func TestClustersWithStorage(t *testing.T) {
+	opaasData := indexFixture()
+	for _, storageID := range []string{"s1", "s2", "s3", ""} {
+		clusterIDs := []string{}
+		for _, cluster := range opaasData.ClustersWithStorage(storageID) {
+			clusterIDs = append(clusterIDs, cluster.ID)
+		}
+		if want := scanClustersWithStorage(opaasData, storageID); !reflect.DeepEqual(clusterIDs, want) {
+			t.Errorf("ClustersWithStorage(%q) = %v, want %v", storageID, clusterIDs, want)
+		}
+	}
+}
+
+func TestClusterhostByName(t *testing.T) {
+	opaasData := indexFixture()
+	for _, hostName := range []string{"host1.example.com", "host2.example.com", "host3.example.com", ""} {
+		want := scanClusterhost(opaasData, hostName)
+		var wantClusterhost *Clusterhost
+		if want >= 0 {
+			wantClusterhost = &opaasData.Clusterhosts[want]
+		}
+		if got := opaasData.ClusterhostByName(hostName); got != wantClusterhost {
+			t.Errorf("ClusterhostByName(%q) = %p, want %p (position %d)", hostName, got, wantClusterhost, want)
+		}
+	}
+}
+
+func TestHasSite(t *testing.T) {
+	opaasData := indexFixture()
+	tests := []struct {
+		site string
+		want bool
+	}{
+		{site: "POK02", want: true},
+		{site: "DAL00", want: true},
+		{site: "WDC07", want: true},
+		{site: "pok02"},
+		{site: "FRA02"},
+	}
+	for _, test := range tests {
+		if got := opaasData.HasSite(test.site); got != test.want {
+			t.Errorf("HasSite(%q) = %v, want %v", test.site, got, test.want)
+		}
+	}
+}
+
+// Patched values are written back through the pointers a lookup returns, so
+// later lookups in the same snapshot must see them.
+func TestLookupsShareTheSnapshot(t *testing.T) {
+	opaasData := indexFixture()
+	opaasData.ClusterhostByName("host1.example.com").ServerID = "12345"
+	if got := opaasData.Clusterhosts[0].ServerID; got != "12345" {
+		t.Errorf("Clusterhosts[0].ServerID = %q, want the value written through the lookup", got)
+	}
+	opaasData.ClusterByName("POK02", "pok02", "esx1").VCenterCPUConsumed = 64
+	if got := opaasData.ClusterForClusterhost("pok02", 1, "esx1").VCenterCPUConsumed; got != 64 {
+		t.Errorf("VCenterCPUConsumed = %d, want 64 from another lookup of the same cluster", got)
+	}
+}
@@ -2,37 +2,47 @@ package client
 
 import (
 	"bytes"
-	"crypto/tls"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/spf13/viper"
+	"github.com/opaas/capacity-worker/metrics"
+	"github.com/opaas/capacity-worker/utils"
 )
 
-type Patch struct {
-	Op    string `json:"op"`
-	Path  string `json:"path"`
-	Value int    `json:"value"`
-}
-
 type OpaasData struct {
 	Instances    []Instance    `json:"Instances"`
 	Storage      []Storage     `json:"Storage"`
 	Clusters     []Cluster     `json:"Clusters"`
 	Clusterhosts []Clusterhost `json:"Clusterhosts"`
+	indexes      *opaasIndexes
 }
 
 type OpaasApi struct {
-	config *opaasConfig
+	config    *opaasConfig
+	responses map[string]*cachedResponse
+	ctx       context.Context
+}
+
+var errInvalidRequest = errors.New("Invalid OPaaS request")
+
+type cachedResponse struct {
+	etag   string
+	body   []byte
+	header http.Header
 }
 
 type opaasConfig struct {
-	baseURL string
-	token   string
+	baseURL         string
+	defaultPageSize int
+	pageSizes       map[string]int
+	maxPages        int
 }
 
 func NewOpaasApi() *OpaasApi {
@@ -42,56 +52,131 @@ func NewOpaasApi() *OpaasApi {
 	}
 }
 
+// NewConditionalOpaasApi returns a client that remembers the ETag of every
+// page it GETs and revalidates with If-None-Match. A 304 answer is served from
+// memory, so a caller that refreshes the same lists repeatedly should keep
+// one of these. It is not safe for concurrent use.
+func NewConditionalOpaasApi() *OpaasApi {
+	opaasApi := NewOpaasApi()
+	opaasApi.responses = make(map[string]*cachedResponse)
+	return opaasApi
+}
+
+// WithContext returns a copy of the client whose requests, including retry
+// waits, are cancelled with ctx.
+func (opaasApi *OpaasApi) WithContext(ctx context.Context) *OpaasApi {
+	withContext := *opaasApi
+	withContext.ctx = ctx
+	return &withContext
+}
+
+func (opaasApi *OpaasApi) context() context.Context {
+	if opaasApi.ctx == nil {
+		return context.Background()
+	}
+	return opaasApi.ctx
+}
+
 func getOpaasConfig() *opaasConfig {
+	config := utils.GetOpaasConfig()
 	return &opaasConfig{
-		baseURL: viper.GetString("OPAAS_BASE_URL"),
-		token:   viper.GetString("OPAAS_APIKEY"),
+		baseURL:         config.BaseURL,
+		defaultPageSize: config.PageSize,
+		pageSizes:       config.PageSizes,
+		maxPages:        config.MaxPages,
 	}
 }
 
 func (opaasApi *OpaasApi) get(endpoint string, output interface{}) error {
-	data, httpErr := opaasApi.makeOpaasHTTPRequest("GET", endpoint, nil)
+	return opaasApi.getAllPages(endpoint, output)
+}
+
+// getPage fetches one page by its full URL. With a conditional client the
+// page is revalidated against the ETag it was last served with.
+func (opaasApi *OpaasApi) getPage(endpoint string, pageURL string) ([]byte, http.Header, error) {
+	header := http.Header{}
+	cached, isCached := opaasApi.responses[pageURL]
+	if isCached {
+		header.Set("If-None-Match", cached.etag)
+	}
+	response, httpErr := opaasApi.do(http.MethodGet, endpoint, pageURL, nil, header)
+	if httpErr != nil {
+		return nil, nil, httpErr
+	}
+	if response.statusCode == http.StatusNotModified {
+		if !isCached {
+			return nil, nil, &StatusError{StatusCode: response.statusCode, Status: "304 Not Modified"}
+		}
+		return cached.body, cached.header, nil
+	}
+	if opaasApi.responses != nil {
+		if etag := response.header.Get("ETag"); etag != "" {
+			opaasApi.responses[pageURL] = &cachedResponse{etag: etag, body: response.body, header: response.header}
+		} else {
+			delete(opaasApi.responses, pageURL)
+		}
+	}
+	return response.body, response.header, nil
+}
+
+func (opaasApi *OpaasApi) post(endpoint string, input interface{}, output interface{}) error {
+	postBytes, marshalError := json.Marshal(input)
+	if marshalError != nil {
+		return marshalError
+	}
+	data, httpErr := opaasApi.makeOpaasHTTPRequest(http.MethodPost, endpoint, postBytes)
 	if httpErr != nil {
 		return httpErr
 	}
+	if len(data) == 0 || output == nil {
+		return nil
+	}
 	return json.Unmarshal(data, output)
 }
 
 func (opaasApi *OpaasApi) patch(model string, id string, patches []Patch) error {
 	endpoint := fmt.Sprintf("%s/%s", model, id)
+	validationErr := validatePatches(patches)
+	if validationErr != nil {
+		return validationErr
+	}
 	patchBytes, marshalError := json.Marshal(patches)
 	if marshalError != nil {
 		return marshalError
 	}
-	patchReader := bytes.NewReader(patchBytes)
-	_, httpErr := opaasApi.makeOpaasHTTPRequest("PATCH", endpoint, patchReader)
+	_, httpErr := opaasApi.makeOpaasHTTPRequest(http.MethodPatch, endpoint, patchBytes)
 	return httpErr
 }
 
-func (opaasApi *OpaasApi) makeOpaasHTTPRequest(verb string, endpoint string, data io.Reader) ([]byte, error) {
-	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-	request := opaasApi.createHTTPRequest(verb, endpoint, data)
-	client := http.DefaultClient
-	response, requestError := client.Do(request)
+func (opaasApi *OpaasApi) makeOpaasHTTPRequest(verb string, endpoint string, data []byte) ([]byte, error) {
+	response, requestError := opaasApi.do(verb, endpoint, opaasApi.constructURL(endpoint), data, nil)
 	if requestError != nil {
 		return nil, requestError
 	}
-	if response.StatusCode != 200 {
-		errMessage := fmt.Sprintf("Received non-200 status code: %s", response.Status)
-		return nil, errors.New(errMessage)
+	return response.body, nil
+}
+
+func observeOpaasRequest(verb string, endpoint string, response *http.Response, requestError error, requestStart time.Time) {
+	endpointLabel := strings.SplitN(endpoint, "/", 2)[0]
+	status := "error"
+	if requestError == nil {
+		status = strconv.Itoa(response.StatusCode)
 	}
-	defer response.Body.Close()
-	return ioutil.ReadAll(response.Body)
+	metrics.OpaasRequests.WithLabelValues(endpointLabel, verb, status).Inc()
+	metrics.OpaasRequestDuration.WithLabelValues(endpointLabel, verb).Observe(time.Since(requestStart).Seconds())
 }
 
-func (opaasApi *OpaasApi) createHTTPRequest(verb string, endpoint string, data io.Reader) *http.Request {
-	url := opaasApi.constructURL(endpoint)
-	request, requestCreationErr := http.NewRequest(verb, url, data)
+func (opaasApi *OpaasApi) createHTTPRequestForURL(ctx context.Context, verb string, url string, data []byte) (*http.Request, error) {
+	var body io.Reader
+	if data != nil {
+		body = bytes.NewReader(data)
+	}
+	request, requestCreationErr := http.NewRequestWithContext(ctx, verb, url, body)
 	if requestCreationErr != nil {
-		panic(requestCreationErr)
+		return nil, fmt.Errorf("%w: %v", errInvalidRequest, requestCreationErr)
 	}
 	opaasApi.addHeadersToRequest(verb, request)
-	return request
+	return request, nil
 }
 
 func (opaasApi *OpaasApi) constructURL(endpoint string) string {
@@ -100,7 +185,7 @@ func (opaasApi *OpaasApi) constructURL(endpoint string) string {
 }
 
 func (opaasApi *OpaasApi) addHeadersToRequest(verb string, request *http.Request) {
-	bearerToken := opaasApi.config.token
+	bearerToken := utils.GetOpaasAPIKey()
 	authHeader := fmt.Sprintf("Bearer %s", bearerToken)
 	request.Header.Add("Authorization", authHeader)
 
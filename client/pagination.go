@@ -0,0 +1,175 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	limit_param  string = "limit"
+	offset_param string = "offset"
+	cursor_param string = "cursor"
+)
+
+var linkNextPattern = regexp.MustCompile(`<([^>]+)>\s*;\s*rel="?next"?`)
+
+// pageEnvelope covers the paged responses OPaaS list endpoints may send
+// instead of a bare array. The records are in data or items, and the next
+// page is given as a link or cursor.
+type pageEnvelope struct {
+	Data       json.RawMessage `json:"data"`
+	Items      json.RawMessage `json:"items"`
+	Next       string          `json:"next"`
+	NextCursor string          `json:"nextCursor"`
+	Links      struct {
+		Next string `json:"next"`
+	} `json:"links"`
+}
+
+// getAllPages reads every page of a list endpoint into output, which must
+// point to a slice. Each page is decoded and appended before the next one is
+// requested. The next page comes from a Link rel="next" header, a next link
+// or cursor in the body or, for bare arrays, the next offset while pages come
+// back full. Paging stops with an error after maxPages pages or if a page
+// points back to one already read.
+func (opaasApi *OpaasApi) getAllPages(endpoint string, output interface{}) error {
+	outputValue := reflect.ValueOf(output)
+	if outputValue.Kind() != reflect.Ptr || outputValue.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("Cannot page %s into %T", endpoint, output)
+	}
+	merged := outputValue.Elem()
+	merged.Set(reflect.MakeSlice(merged.Type(), 0, 0))
+	pageSize := opaasApi.pageSize(endpoint)
+	offset := 0
+	pageURL := opaasApi.firstPageURL(endpoint, pageSize)
+	requested := make(map[string]bool)
+	for page := 1; pageURL != ""; page++ {
+		if page > opaasApi.config.maxPages {
+			return fmt.Errorf("Stopped paging %s after %d pages", endpoint, opaasApi.config.maxPages)
+		}
+		if requested[pageURL] {
+			return fmt.Errorf("Paging %s returned to %s", endpoint, pageURL)
+		}
+		requested[pageURL] = true
+		data, header, httpErr := opaasApi.getPage(endpoint, pageURL)
+		if httpErr != nil {
+			return httpErr
+		}
+		records, nextPage, parseErr := parsePage(data, header)
+		if parseErr != nil {
+			return fmt.Errorf("Unable to parse page %d of %s: %w", page, endpoint, parseErr)
+		}
+		pageRecords := reflect.New(merged.Type())
+		if len(records) != 0 {
+			unmarshalErr := json.Unmarshal(records, pageRecords.Interface())
+			if unmarshalErr != nil {
+				return unmarshalErr
+			}
+		}
+		merged.Set(reflect.AppendSlice(merged, pageRecords.Elem()))
+		pageLength := pageRecords.Elem().Len()
+		offset += pageLength
+		pageURL = opaasApi.nextPageURL(endpoint, pageURL, nextPage, pageSize, offset, pageLength)
+	}
+	return nil
+}
+
+func (opaasApi *OpaasApi) pageSize(endpoint string) int {
+	if pageSize, found := opaasApi.config.pageSizes[endpoint]; found {
+		return pageSize
+	}
+	return opaasApi.config.defaultPageSize
+}
+
+func (opaasApi *OpaasApi) firstPageURL(endpoint string, pageSize int) string {
+	firstPage := opaasApi.constructURL(endpoint)
+	if pageSize <= 0 {
+		return firstPage
+	}
+	return withQuery(firstPage, url.Values{
+		limit_param:  {strconv.Itoa(pageSize)},
+		offset_param: {"0"},
+	})
+}
+
+type nextPage struct {
+	link   string
+	cursor string
+}
+
+// nextPageURL resolves the page after currentURL, or returns "" when the
+// endpoint has no more pages.
+func (opaasApi *OpaasApi) nextPageURL(endpoint string, currentURL string, next nextPage, pageSize int, offset int, pageLength int) string {
+	if next.link != "" {
+		base, baseErr := url.Parse(currentURL)
+		link, linkErr := url.Parse(next.link)
+		if baseErr != nil || linkErr != nil {
+			return ""
+		}
+		return base.ResolveReference(link).String()
+	}
+	if next.cursor != "" {
+		query := url.Values{cursor_param: {next.cursor}}
+		if pageSize > 0 {
+			query.Set(limit_param, strconv.Itoa(pageSize))
+		}
+		return withQuery(opaasApi.constructURL(endpoint), query)
+	}
+	if pageSize > 0 && pageLength == pageSize {
+		return withQuery(opaasApi.constructURL(endpoint), url.Values{
+			limit_param:  {strconv.Itoa(pageSize)},
+			offset_param: {strconv.Itoa(offset)},
+		})
+	}
+	return ""
+}
+
+func parsePage(data []byte, header http.Header) (json.RawMessage, nextPage, error) {
+	next := nextPage{}
+	if match := linkNextPattern.FindStringSubmatch(header.Get("Link")); match != nil {
+		next.link = match[1]
+	}
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || trimmed[0] == '[' {
+		return trimmed, next, nil
+	}
+	envelope := pageEnvelope{}
+	unmarshalErr := json.Unmarshal(trimmed, &envelope)
+	if unmarshalErr != nil {
+		return nil, next, unmarshalErr
+	}
+	records := envelope.Data
+	if len(records) == 0 {
+		records = envelope.Items
+	}
+	if next.link == "" {
+		next.link = envelope.Links.Next
+	}
+	next.cursor = envelope.NextCursor
+	if isLink(envelope.Next) {
+		if next.link == "" {
+			next.link = envelope.Next
+		}
+	} else if next.cursor == "" {
+		next.cursor = envelope.Next
+	}
+	if string(records) == "null" {
+		records = nil
+	}
+	return records, next, nil
+}
+
+func isLink(next string) bool {
+	return strings.HasPrefix(next, "/") || strings.HasPrefix(next, "?") || strings.Contains(next, "://")
+}
+
+func withQuery(rawURL string, query url.Values) string {
+	return fmt.Sprintf("%s?%s", rawURL, query.Encode())
+}
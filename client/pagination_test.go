@@ -0,0 +1,204 @@
+package client
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParsePage(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		link       string
+		wantRecord string
+		wantNext   nextPage
+		wantErr    bool
+	}{
+		{
+			name:       "bare array without more pages",
+			body:       `[{"id":"1"}]`,
+			wantRecord: `[{"id":"1"}]`,
+		},
+		{
+			name:       "bare array with Link header",
+			body:       `[{"id":"1"}]`,
+			link:       `</api/clusters?page=2>; rel="next"`,
+			wantRecord: `[{"id":"1"}]`,
+			wantNext:   nextPage{link: "/api/clusters?page=2"},
+		},
+		{
+			name:       "Link header with several relations",
+			body:       `[]`,
+			link:       `<https://opaas.example.com/api/clusters?page=1>; rel="prev", <https://opaas.example.com/api/clusters?page=3>; rel=next`,
+			wantRecord: `[]`,
+			wantNext:   nextPage{link: "https://opaas.example.com/api/clusters?page=3"},
+		},
+		{
+			name:       "Link header without next",
+			body:       `[]`,
+			link:       `</api/clusters?page=1>; rel="prev"`,
+			wantRecord: `[]`,
+		},
+		{
+			name:       "Link header wins over links.next",
+			body:       `{"data":[],"links":{"next":"/api/clusters?page=9"}}`,
+			link:       `</api/clusters?page=2>; rel="next"`,
+			wantRecord: `[]`,
+			wantNext:   nextPage{link: "/api/clusters?page=2"},
+		},
+		{
+			name:       "data with links.next",
+			body:       `{"data":[{"id":"1"}],"links":{"next":"/api/clusters?page=2"}}`,
+			wantRecord: `[{"id":"1"}]`,
+			wantNext:   nextPage{link: "/api/clusters?page=2"},
+		},
+		{
+			name:       "items with nextCursor",
+			body:       `{"items":[{"id":"1"}],"nextCursor":"abc"}`,
+			wantRecord: `[{"id":"1"}]`,
+			wantNext:   nextPage{cursor: "abc"},
+		},
+		{
+			name:       "next as cursor",
+			body:       `{"data":[],"next":"abc"}`,
+			wantRecord: `[]`,
+			wantNext:   nextPage{cursor: "abc"},
+		},
+		{
+			name:       "next as query link",
+			body:       `{"data":[],"next":"?page=2"}`,
+			wantRecord: `[]`,
+			wantNext:   nextPage{link: "?page=2"},
+		},
+		{
+			name:       "next as absolute link",
+			body:       `{"data":[],"next":"https://opaas.example.com/api/clusters?page=2"}`,
+			wantRecord: `[]`,
+			wantNext:   nextPage{link: "https://opaas.example.com/api/clusters?page=2"},
+		},
+		{
+			name: "null data on the last page",
+			body: `{"data":null}`,
+		},
+		{
+			name: "empty body",
+			body: " \n",
+		},
+		{
+			name:    "malformed envelope",
+			body:    `{"data":`,
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := http.Header{}
+			if test.link != "" {
+				header.Set("Link", test.link)
+			}
+			records, next, parseErr := parsePage([]byte(test.body), header)
+			if (parseErr != nil) != test.wantErr {
+				t.Fatalf("parsePage() error = %v, wantErr %v", parseErr, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			if string(records) != test.wantRecord {
+				t.Errorf("parsePage() records = %s, want %s", records, test.wantRecord)
+			}
+			if next != test.wantNext {
+				t.Errorf("parsePage() next = %+v, want %+v", next, test.wantNext)
+			}
+		})
+	}
+}
+
+func TestNextPageURL(t *testing.T) {
+	opaasApi := &OpaasApi{config: &opaasConfig{baseURL: "https://opaas.example.com/api"}}
+	tests := []struct {
+		name       string
+		currentURL string
+		next       nextPage
+		pageSize   int
+		offset     int
+		pageLength int
+		want       string
+	}{
+		{
+			name:       "relative link",
+			currentURL: "https://opaas.example.com/api/clusters?limit=2&offset=0",
+			next:       nextPage{link: "/api/clusters?page=2"},
+			want:       "https://opaas.example.com/api/clusters?page=2",
+		},
+		{
+			name:       "query link",
+			currentURL: "https://opaas.example.com/api/clusters?page=1",
+			next:       nextPage{link: "?page=2"},
+			want:       "https://opaas.example.com/api/clusters?page=2",
+		},
+		{
+			name:       "absolute link",
+			currentURL: "https://opaas.example.com/api/clusters",
+			next:       nextPage{link: "https://other.example.com/clusters?page=2"},
+			want:       "https://other.example.com/clusters?page=2",
+		},
+		{
+			name:       "link wins over cursor and offset",
+			currentURL: "https://opaas.example.com/api/clusters",
+			next:       nextPage{link: "/api/clusters?page=2", cursor: "abc"},
+			pageSize:   2,
+			offset:     2,
+			pageLength: 2,
+			want:       "https://opaas.example.com/api/clusters?page=2",
+		},
+		{
+			name:       "cursor with page size",
+			currentURL: "https://opaas.example.com/api/clusters",
+			next:       nextPage{cursor: "abc"},
+			pageSize:   50,
+			pageLength: 10,
+			want:       "https://opaas.example.com/api/clusters?cursor=abc&limit=50",
+		},
+		{
+			name:       "cursor without page size",
+			currentURL: "https://opaas.example.com/api/clusters",
+			next:       nextPage{cursor: "abc"},
+			want:       "https://opaas.example.com/api/clusters?cursor=abc",
+		},
+		{
+			name:       "full page continues at the next offset",
+			currentURL: "https://opaas.example.com/api/clusters?limit=2&offset=2",
+			pageSize:   2,
+			offset:     4,
+			pageLength: 2,
+			want:       "https://opaas.example.com/api/clusters?limit=2&offset=4",
+		},
+		{
+			name:       "short page ends paging",
+			currentURL: "https://opaas.example.com/api/clusters?limit=2&offset=2",
+			pageSize:   2,
+			offset:     3,
+			pageLength: 1,
+		},
+		{
+			name:       "empty page ends paging",
+			currentURL: "https://opaas.example.com/api/clusters?limit=2&offset=4",
+			pageSize:   2,
+			offset:     4,
+		},
+		{
+			name:       "bare array without page size ends paging",
+			currentURL: "https://opaas.example.com/api/clusters",
+			offset:     500,
+			pageLength: 500,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := opaasApi.nextPageURL("clusters", test.currentURL, test.next, test.pageSize, test.offset, test.pageLength)
+			if got != test.want {
+				t.Errorf("nextPageURL() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// JSON Patch operations from RFC 6902.
+const (
+	PatchAdd     string = "add"
+	PatchRemove  string = "remove"
+	PatchReplace string = "replace"
+	PatchMove    string = "move"
+	PatchCopy    string = "copy"
+	PatchTest    string = "test"
+)
+
+// Patch is one RFC 6902 operation. Value may be any JSON value; it is sent
+// for add, replace and test, even when nil, and left out otherwise. From is
+// only used by move and copy, and is sent for them even when it is the empty
+// pointer to the whole document.
+type Patch struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+func (patch Patch) MarshalJSON() ([]byte, error) {
+	type patchWithoutValue struct {
+		Op   string `json:"op"`
+		Path string `json:"path"`
+	}
+	type patchWithFrom struct {
+		Op   string `json:"op"`
+		Path string `json:"path"`
+		From string `json:"from"`
+	}
+	type patchWithValue struct {
+		Op    string      `json:"op"`
+		Path  string      `json:"path"`
+		Value interface{} `json:"value"`
+	}
+	switch patch.Op {
+	case PatchAdd, PatchReplace, PatchTest:
+		return json.Marshal(patchWithValue{Op: patch.Op, Path: patch.Path, Value: patch.Value})
+	case PatchMove, PatchCopy:
+		return json.Marshal(patchWithFrom{Op: patch.Op, Path: patch.Path, From: patch.From})
+	default:
+		return json.Marshal(patchWithoutValue{Op: patch.Op, Path: patch.Path})
+	}
+}
+
+func AddPatch(path string, value interface{}) Patch {
+	return Patch{Op: PatchAdd, Path: path, Value: value}
+}
+
+func RemovePatch(path string) Patch {
+	return Patch{Op: PatchRemove, Path: path}
+}
+
+func ReplacePatch(path string, value interface{}) Patch {
+	return Patch{Op: PatchReplace, Path: path, Value: value}
+}
+
+func MovePatch(from string, path string) Patch {
+	return Patch{Op: PatchMove, Path: path, From: from}
+}
+
+func CopyPatch(from string, path string) Patch {
+	return Patch{Op: PatchCopy, Path: path, From: from}
+}
+
+func TestPatch(path string, value interface{}) Patch {
+	return Patch{Op: PatchTest, Path: path, Value: value}
+}
+
+// GuardedReplacePatches replaces path only if it still holds oldValue. If
+// someone changed it since it was read the whole patch document is rejected
+// and IsConflict reports the error.
+func GuardedReplacePatches(path string, oldValue interface{}, newValue interface{}) []Patch {
+	return []Patch{
+		TestPatch(path, oldValue),
+		ReplacePatch(path, newValue),
+	}
+}
+
+func validatePatches(patches []Patch) error {
+	for i, patch := range patches {
+		if !isJSONPointer(patch.Path) {
+			return fmt.Errorf("Patch %d has invalid path %q", i, patch.Path)
+		}
+		switch patch.Op {
+		case PatchAdd, PatchRemove, PatchReplace, PatchTest:
+		case PatchMove, PatchCopy:
+			if !isJSONPointer(patch.From) {
+				return fmt.Errorf("Patch %d has invalid from %q", i, patch.From)
+			}
+			if patch.Op == PatchMove && strings.HasPrefix(patch.Path, patch.From+"/") {
+				return fmt.Errorf("Patch %d moves %q into its own child %q", i, patch.From, patch.Path)
+			}
+		default:
+			return fmt.Errorf("Patch %d has unknown op %q", i, patch.Op)
+		}
+	}
+	return nil
+}
+
+// isJSONPointer checks pointer against RFC 6901: it is empty, for the whole
+// document, or a list of "/" prefixed tokens in which "~" is only used in the
+// escapes "~0" and "~1".
+func isJSONPointer(pointer string) bool {
+	if pointer == "" {
+		return true
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return false
+	}
+	for i := 0; i < len(pointer); i++ {
+		if pointer[i] != '~' {
+			continue
+		}
+		if i+1 == len(pointer) || (pointer[i+1] != '0' && pointer[i+1] != '1') {
+			return false
+		}
+	}
+	return true
+}
+
+// IsConflict reports whether OPaaS refused a patch because a test operation
+// failed, i.e. the record changed after it was read. A 422 is not a conflict:
+// it means the patch itself is malformed, e.g. it names a path that does not
+// exist.
+func IsConflict(err error) bool {
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	return statusErr.StatusCode == http.StatusConflict ||
+		statusErr.StatusCode == http.StatusPreconditionFailed
+}
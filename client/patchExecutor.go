@@ -0,0 +1,71 @@
+package client
+
+import (
+	"sync"
+)
+
+// PatchRequest is a patch document for one OPaaS record.
+type PatchRequest struct {
+	endpoint string
+	ID       string
+	Patches  []Patch
+}
+
+// PatchResult is the outcome of one PatchRequest. Err is nil on success.
+type PatchResult struct {
+	Request PatchRequest
+	Err     error
+}
+
+func NewClusterPatchRequest(clusterId string, patches []Patch) PatchRequest {
+	return PatchRequest{endpoint: cluster_endpoint, ID: clusterId, Patches: patches}
+}
+
+func NewStoragePatchRequest(storageId string, patches []Patch) PatchRequest {
+	return PatchRequest{endpoint: storage_endpoint, ID: storageId, Patches: patches}
+}
+
+func NewClusterhostPatchRequest(clusterhostId string, patches []Patch) PatchRequest {
+	return PatchRequest{endpoint: clusterhost_endpoint, ID: clusterhostId, Patches: patches}
+}
+
+// PatchExecutor sends many patch documents over one client, at most
+// concurrency at a time.
+type PatchExecutor struct {
+	opaasApi    *OpaasApi
+	concurrency int
+}
+
+func NewPatchExecutor(concurrency int) *PatchExecutor {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &PatchExecutor{
+		opaasApi:    NewOpaasApi(),
+		concurrency: concurrency,
+	}
+}
+
+// Execute sends every request and returns one result per request, in the
+// same order. A failing request does not stop the others.
+func (executor *PatchExecutor) Execute(requests []PatchRequest) []PatchResult {
+	results := make([]PatchResult, len(requests))
+	slots := make(chan struct{}, executor.concurrency)
+	var inFlight sync.WaitGroup
+	for i, request := range requests {
+		slots <- struct{}{}
+		inFlight.Add(1)
+		go func(i int, request PatchRequest) {
+			defer func() {
+				<-slots
+				inFlight.Done()
+			}()
+			results[i] = PatchResult{
+				Request: request,
+				Err:     executor.opaasApi.patch(request.endpoint, request.ID, request.Patches),
+			}
+		}(i, request)
+	}
+	inFlight.Wait()
+	return results
+}
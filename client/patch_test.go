@@ -0,0 +1,65 @@
+package client
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestValidatePatches(t *testing.T) {
+	tests := []struct {
+		name    string
+		patch   Patch
+		wantErr bool
+	}{
+		{name: "replace field", patch: ReplacePatch("/serverId", "123")},
+		{name: "replace whole document", patch: ReplacePatch("", map[string]interface{}{})},
+		{name: "test whole document", patch: TestPatch("", nil)},
+		{name: "array index", patch: RemovePatch("/workloadTypes/0")},
+		{name: "append to array", patch: AddPatch("/workloadTypes/-", "db")},
+		{name: "empty token", patch: AddPatch("/", 1)},
+		{name: "escaped slash", patch: ReplacePatch("/labels/a~1b", "x")},
+		{name: "escaped tilde", patch: ReplacePatch("/labels/a~0b", "x")},
+		{name: "missing leading slash", patch: ReplacePatch("serverId", "123"), wantErr: true},
+		{name: "bare tilde", patch: ReplacePatch("/labels/a~b", "x"), wantErr: true},
+		{name: "trailing tilde", patch: ReplacePatch("/labels/a~", "x"), wantErr: true},
+		{name: "unknown escape", patch: ReplacePatch("/labels/~2", "x"), wantErr: true},
+		{name: "copy from whole document", patch: CopyPatch("", "/backup")},
+		{name: "move between fields", patch: MovePatch("/old", "/new")},
+		{name: "move into own child", patch: MovePatch("/a", "/a/b"), wantErr: true},
+		{name: "move to sibling with shared prefix", patch: MovePatch("/a", "/ab")},
+		{name: "move from invalid pointer", patch: MovePatch("a", "/b"), wantErr: true},
+		{name: "unknown op", patch: Patch{Op: "merge", Path: "/a"}, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			validateErr := validatePatches([]Patch{test.patch})
+			if (validateErr != nil) != test.wantErr {
+				t.Errorf("validatePatches() error = %v, wantErr %v", validateErr, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestPatchMarshalJSON(t *testing.T) {
+	tests := []struct {
+		name  string
+		patch Patch
+		want  string
+	}{
+		{name: "replace with nil value", patch: ReplacePatch("/status", nil), want: `{"op":"replace","path":"/status","value":null}`},
+		{name: "remove", patch: RemovePatch("/status"), want: `{"op":"remove","path":"/status"}`},
+		{name: "copy from whole document", patch: CopyPatch("", "/backup"), want: `{"op":"copy","path":"/backup","from":""}`},
+		{name: "move", patch: MovePatch("/old", "/new"), want: `{"op":"move","path":"/new","from":"/old"}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, marshalErr := json.Marshal(test.patch)
+			if marshalErr != nil {
+				t.Fatal(marshalErr)
+			}
+			if string(data) != test.want {
+				t.Errorf("json.Marshal() = %s, want %s", data, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/opaas/capacity-worker/utils"
+)
+
+const (
+	retry_backoff_min  time.Duration = 500 * time.Millisecond
+	retry_backoff_max  time.Duration = 30 * time.Second
+	retry_after_max    time.Duration = 2 * time.Minute
+	error_body_excerpt int           = 512
+)
+
+// StatusError is returned for any response outside 2xx, once retries are
+// spent.
+type StatusError struct {
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (statusErr *StatusError) Error() string {
+	if statusErr.Body == "" {
+		return fmt.Sprintf("Received non-2xx status code: %s", statusErr.Status)
+	}
+	return fmt.Sprintf("Received non-2xx status code: %s: %s", statusErr.Status, statusErr.Body)
+}
+
+type opaasResponse struct {
+	statusCode int
+	header     http.Header
+	body       []byte
+}
+
+var (
+	httpClientOnce   sync.Once
+	sharedHTTPClient *http.Client
+	httpClientErr    error
+)
+
+// opaasHTTPClient returns the client shared by every OpaasApi, so
+// connections are reused across calls. Its TLS settings come from
+// CAP_OPAAS_CA_BUNDLE, CAP_OPAAS_CLIENT_CERT/KEY and
+// CAP_OPAAS_INSECURE_SKIP_VERIFY and never touch http.DefaultTransport.
+func opaasHTTPClient() (*http.Client, error) {
+	httpClientOnce.Do(func() {
+		tlsConfig, tlsErr := createTLSConfig(utils.GetOpaasHTTPConfig())
+		if tlsErr != nil {
+			httpClientErr = tlsErr
+			return
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		sharedHTTPClient = &http.Client{Transport: transport}
+	})
+	return sharedHTTPClient, httpClientErr
+}
+
+func createTLSConfig(httpConfig *utils.OpaasHTTPConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: httpConfig.InsecureSkipVerify,
+	}
+	if httpConfig.CABundle != "" {
+		caBundle, readErr := ioutil.ReadFile(httpConfig.CABundle)
+		if readErr != nil {
+			return nil, fmt.Errorf("Unable to read OPaaS CA bundle: %w", readErr)
+		}
+		rootCAs := x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(caBundle) {
+			return nil, errors.New("OPaaS CA bundle contains no PEM certificates")
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+	if httpConfig.ClientCert != "" {
+		certificate, certErr := tls.LoadX509KeyPair(httpConfig.ClientCert, httpConfig.ClientKey)
+		if certErr != nil {
+			return nil, fmt.Errorf("Unable to load OPaaS client certificate: %w", certErr)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
+
+// do sends a request and returns the response with its body read. Network
+// errors, 5xx and 429 are retried with jittered backoff, or after the
+// Retry-After delay when the server sends one. A POST is only retried on 429,
+// since the server may have acted on it otherwise. 304 is passed back for
+// conditional GETs; every other status outside 2xx is a *StatusError.
+func (opaasApi *OpaasApi) do(verb string, endpoint string, requestURL string, body []byte, header http.Header) (*opaasResponse, error) {
+	httpClient, clientErr := opaasHTTPClient()
+	if clientErr != nil {
+		return nil, clientErr
+	}
+	httpConfig := utils.GetOpaasHTTPConfig()
+	for attempt := 1; ; attempt++ {
+		response, requestErr := opaasApi.attempt(httpClient, httpConfig.Timeout, verb, endpoint, requestURL, body, header)
+		if opaasApi.context().Err() != nil {
+			return nil, opaasApi.context().Err()
+		}
+		if !shouldRetry(verb, response, requestErr) || attempt > httpConfig.MaxRetries {
+			return checkStatus(response, requestErr)
+		}
+		select {
+		case <-time.After(retryDelay(attempt, response)):
+		case <-opaasApi.context().Done():
+			return nil, opaasApi.context().Err()
+		}
+	}
+}
+
+func (opaasApi *OpaasApi) attempt(httpClient *http.Client, timeout time.Duration, verb string, endpoint string, requestURL string, body []byte, header http.Header) (*opaasResponse, error) {
+	var contextWithTimeout context.Context
+	var cancelTimeout context.CancelFunc
+	if timeout > 0 {
+		contextWithTimeout, cancelTimeout = context.WithTimeout(opaasApi.context(), timeout)
+	} else {
+		contextWithTimeout, cancelTimeout = context.WithCancel(opaasApi.context())
+	}
+	defer cancelTimeout()
+	request, requestErr := opaasApi.createHTTPRequestForURL(contextWithTimeout, verb, requestURL, body)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	requestStart := time.Now()
+	response, responseErr := httpClient.Do(request)
+	observeOpaasRequest(verb, endpoint, response, responseErr, requestStart)
+	if responseErr != nil {
+		return nil, responseErr
+	}
+	defer response.Body.Close()
+	data, readErr := ioutil.ReadAll(response.Body)
+	if readErr != nil {
+		return nil, readErr
+	}
+	return &opaasResponse{
+		statusCode: response.StatusCode,
+		header:     response.Header,
+		body:       data,
+	}, nil
+}
+
+func shouldRetry(verb string, response *opaasResponse, requestErr error) bool {
+	if requestErr != nil {
+		return verb != http.MethodPost && !errors.Is(requestErr, errInvalidRequest)
+	}
+	if response.statusCode == http.StatusTooManyRequests {
+		return true
+	}
+	return response.statusCode >= 500 && verb != http.MethodPost
+}
+
+// IsTemporary reports whether a failed request may succeed if it is sent
+// again: network errors, timeouts, 429 and 5xx. Any other status means OPaaS
+// refused the request itself.
+func IsTemporary(err error) bool {
+	if err == nil || errors.Is(err, errInvalidRequest) {
+		return false
+	}
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		return true
+	}
+	return statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode >= 500
+}
+
+func retryDelay(attempt int, response *opaasResponse) time.Duration {
+	if response != nil {
+		if retryAfter, found := parseRetryAfter(response.header.Get("Retry-After")); found {
+			if retryAfter > retry_after_max {
+				return retry_after_max
+			}
+			return retryAfter
+		}
+	}
+	return utils.JitteredBackoff(attempt, retry_backoff_min, retry_backoff_max)
+}
+
+// parseRetryAfter reads either form of Retry-After: delay seconds or an HTTP
+// date.
+func parseRetryAfter(retryAfter string) (time.Duration, bool) {
+	if retryAfter == "" {
+		return 0, false
+	}
+	if seconds, atoiErr := strconv.Atoi(retryAfter); atoiErr == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if retryAt, parseErr := http.ParseTime(retryAfter); parseErr == nil {
+		delay := time.Until(retryAt)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+	return 0, false
+}
+
+func checkStatus(response *opaasResponse, requestErr error) (*opaasResponse, error) {
+	if requestErr != nil {
+		return nil, requestErr
+	}
+	if response.statusCode/100 == 2 || response.statusCode == http.StatusNotModified {
+		return response, nil
+	}
+	excerpt := string(response.body)
+	if len(excerpt) > error_body_excerpt {
+		excerpt = excerpt[:error_body_excerpt]
+	}
+	return nil, &StatusError{
+		StatusCode: response.statusCode,
+		Status:     fmt.Sprintf("%d %s", response.statusCode, http.StatusText(response.statusCode)),
+		Body:       excerpt,
+	}
+}
@@ -0,0 +1,124 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name       string
+		retryAfter string
+		wantFound  bool
+		wantMin    time.Duration
+		wantMax    time.Duration
+	}{
+		{name: "missing"},
+		{name: "seconds", retryAfter: "120", wantFound: true, wantMin: 2 * time.Minute, wantMax: 2 * time.Minute},
+		{name: "zero seconds", retryAfter: "0", wantFound: true},
+		{name: "negative seconds", retryAfter: "-5"},
+		{name: "fractional seconds", retryAfter: "1.5"},
+		{name: "garbage", retryAfter: "soon"},
+		{
+			name:       "future HTTP date",
+			retryAfter: now.Add(90 * time.Second).UTC().Format(http.TimeFormat),
+			wantFound:  true,
+			wantMin:    88 * time.Second,
+			wantMax:    90 * time.Second,
+		},
+		{
+			name:       "past HTTP date",
+			retryAfter: now.Add(-time.Hour).UTC().Format(http.TimeFormat),
+			wantFound:  true,
+		},
+		{
+			name:       "RFC 850 date",
+			retryAfter: now.Add(time.Hour).UTC().Format(time.RFC850),
+			wantFound:  true,
+			wantMin:    58 * time.Minute,
+			wantMax:    time.Hour,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			delay, found := parseRetryAfter(test.retryAfter)
+			if found != test.wantFound {
+				t.Fatalf("parseRetryAfter(%q) found = %v, want %v", test.retryAfter, found, test.wantFound)
+			}
+			if delay < test.wantMin || delay > test.wantMax {
+				t.Errorf("parseRetryAfter(%q) = %s, want between %s and %s", test.retryAfter, delay, test.wantMin, test.wantMax)
+			}
+		})
+	}
+}
+
+func TestRetryDelayCapsRetryAfter(t *testing.T) {
+	response := &opaasResponse{header: http.Header{"Retry-After": {"3600"}}}
+	if delay := retryDelay(1, response); delay != retry_after_max {
+		t.Errorf("retryDelay() = %s, want %s", delay, retry_after_max)
+	}
+}
+
+func TestShouldRetry(t *testing.T) {
+	networkErr := errors.New("connection reset by peer")
+	tests := []struct {
+		name       string
+		verb       string
+		statusCode int
+		requestErr error
+		want       bool
+	}{
+		{name: "GET network error", verb: http.MethodGet, requestErr: networkErr, want: true},
+		{name: "PATCH network error", verb: http.MethodPatch, requestErr: networkErr, want: true},
+		{name: "POST network error", verb: http.MethodPost, requestErr: networkErr},
+		{name: "GET invalid request", verb: http.MethodGet, requestErr: errInvalidRequest},
+		{name: "GET 200", verb: http.MethodGet, statusCode: http.StatusOK},
+		{name: "GET 304", verb: http.MethodGet, statusCode: http.StatusNotModified},
+		{name: "GET 404", verb: http.MethodGet, statusCode: http.StatusNotFound},
+		{name: "PATCH 409", verb: http.MethodPatch, statusCode: http.StatusConflict},
+		{name: "GET 429", verb: http.MethodGet, statusCode: http.StatusTooManyRequests, want: true},
+		{name: "POST 429", verb: http.MethodPost, statusCode: http.StatusTooManyRequests, want: true},
+		{name: "GET 500", verb: http.MethodGet, statusCode: http.StatusInternalServerError, want: true},
+		{name: "PATCH 503", verb: http.MethodPatch, statusCode: http.StatusServiceUnavailable, want: true},
+		{name: "POST 500", verb: http.MethodPost, statusCode: http.StatusInternalServerError},
+		{name: "POST 502", verb: http.MethodPost, statusCode: http.StatusBadGateway},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var response *opaasResponse
+			if test.requestErr == nil {
+				response = &opaasResponse{statusCode: test.statusCode}
+			}
+			if got := shouldRetry(test.verb, response, test.requestErr); got != test.want {
+				t.Errorf("shouldRetry() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestIsTemporary(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "no error"},
+		{name: "network error", err: errors.New("connection reset by peer"), want: true},
+		{name: "invalid request", err: fmt.Errorf("%w: bad url", errInvalidRequest)},
+		{name: "404", err: &StatusError{StatusCode: http.StatusNotFound}},
+		{name: "422", err: &StatusError{StatusCode: http.StatusUnprocessableEntity}},
+		{name: "429", err: &StatusError{StatusCode: http.StatusTooManyRequests}, want: true},
+		{name: "wrapped 503", err: fmt.Errorf("patch: %w", &StatusError{StatusCode: http.StatusServiceUnavailable}), want: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := IsTemporary(test.err); got != test.want {
+				t.Errorf("IsTemporary(%v) = %v, want %v", test.err, got, test.want)
+			}
+		})
+	}
+}
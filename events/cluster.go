@@ -3,11 +3,18 @@ package events
 import (
 	"strconv"
 
+	"github.com/opaas/capacity-worker/aliases"
 	"github.com/opaas/capacity-worker/client"
+	"github.com/opaas/capacity-worker/softlayer"
 	"github.com/opaas/capacity-worker/utils"
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	vcenter_cpu_path    string = "/vCenterCpuConsumed"
+	vcenter_memory_path string = "/vCenterMemoryConsumed"
+)
+
 type Cluster struct {
 	SiteID                 string  `json:"SITE_ID"`
 	Pod                    string  `json:"PODID"`
@@ -30,49 +37,87 @@ type ClusterEvent struct {
 	Clusters   []Cluster `json:"data"`
 }
 
-func (event ClusterEvent) Process(offset int64, opaasData *client.OpaasData, SlData []utils.SoftLayerHosts) {
-	if event.StreamName == "xseries.resource_pool" {
-		processResourcePools(offset, event, opaasData)
-		return
-	}
-	processClusters(offset, event, opaasData)
-}
-
-func processResourcePools(offset int64, event ClusterEvent, opaasData *client.OpaasData) {
-	for _, resourcePool := range event.Clusters {
+type ResourcePoolEvent struct {
+	StreamName    string    `json:"streamName"`
+	ResourcePools []Cluster `json:"data"`
+}
+
+func init() {
+	RegisterHandler(Handler{
+		Schemas: map[int]RecordSchema{
+			1: {
+				RequiredFields: []string{"SITE_ID", "DATACENTER", "ESXNAME", "VCPU_REQUESTED", "MEMORY_REQUESTED_GB", "VERSION"},
+				NewRecord:      func() interface{} { return &Cluster{} },
+			},
+		},
+		Decode: func(envelope *Envelope) (Event, error) {
+			event := &ClusterEvent{}
+			return event, envelope.Decode(event)
+		},
+	}, "xseries.esx_cluster")
+	RegisterHandler(Handler{
+		Schemas: map[int]RecordSchema{
+			1: {
+				RequiredFields: []string{"SITE_ID", "PODID", "DATACENTER", "POOL_NAME", "VCPU_REQUESTED", "MEMORY_REQUESTED_GB", "VERSION"},
+				NewRecord:      func() interface{} { return &Cluster{} },
+			},
+		},
+		Decode: func(envelope *Envelope) (Event, error) {
+			event := &ResourcePoolEvent{}
+			return event, envelope.Decode(event)
+		},
+	}, "xseries.resource_pool")
+}
+
+func (event ClusterEvent) Process(partition int, offset int64, opaasData *client.OpaasData, SlData *softlayer.Data) error {
+	return processClusters(newPatchBatch(partition, offset), event, opaasData)
+}
+
+func (event ResourcePoolEvent) Process(partition int, offset int64, opaasData *client.OpaasData, SlData *softlayer.Data) error {
+	return processResourcePools(newPatchBatch(partition, offset), event, opaasData)
+}
+
+func processResourcePools(batch *patchBatch, event ResourcePoolEvent, opaasData *client.OpaasData) error {
+	for _, resourcePool := range event.ResourcePools {
 		if is3x(resourcePool) {
-			processResourcePool(offset, resourcePool, opaasData)
+			processResourcePool(batch, resourcePool, opaasData)
 		}
 	}
+	return batch.send()
 }
 
-func processClusters(offset int64, event ClusterEvent, opaasData *client.OpaasData) {
+func processClusters(batch *patchBatch, event ClusterEvent, opaasData *client.OpaasData) error {
 	for _, cluster := range event.Clusters {
 		if !is3x(cluster) {
-			processCluster(offset, cluster, opaasData)
+			processCluster(batch, cluster, opaasData)
 		}
 	}
+	return batch.send()
 }
 
 func is3x(cluster Cluster) bool {
 	return cluster.Version == "CMS 3.x"
 }
 
-func processResourcePool(offset int64, resourcePool Cluster, opaasData *client.OpaasData) {
-	resourcePool.SiteID = mapSites(resourcePool.SiteID)
+func processResourcePool(batch *patchBatch, resourcePool Cluster, opaasData *client.OpaasData) {
+	resourcePool.SiteID = mapSites(resourcePool.SiteID, opaasData)
+	resourcePool.Datacenter = aliases.Datacenter(resourcePool.Datacenter)
+	resourcePool.Pod = aliases.Pod(resourcePool.Pod)
 	opaasCluster := findMatchingOpaasClusterWithResourcePool(resourcePool, opaasData)
 	if opaasCluster != nil {
 		// sendClusterSlackMessage(resourcePool, opaasCluster.Profile)
-		patchClusterIfNecessary(resourcePool, opaasCluster)
+		patchClusterIfNecessary(batch, resourcePool, opaasCluster)
 	}
 }
 
-func processCluster(offset int64, cluster Cluster, opaasData *client.OpaasData) {
-	cluster.SiteID = mapSites(cluster.SiteID)
-	opaasCluster := findMatchingOpaasClusterWithCluster(cluster, opaasData.Clusters)
+func processCluster(batch *patchBatch, cluster Cluster, opaasData *client.OpaasData) {
+	cluster.SiteID = mapSites(cluster.SiteID, opaasData)
+	cluster.Datacenter = aliases.Datacenter(cluster.Datacenter)
+	cluster.Pod = aliases.Pod(cluster.Pod)
+	opaasCluster := findMatchingOpaasClusterWithCluster(cluster, opaasData)
 	if opaasCluster != nil {
 		// sendClusterSlackMessage(cluster, opaasCluster.Profile)
-		patchClusterIfNecessary(cluster, opaasCluster)
+		patchClusterIfNecessary(batch, cluster, opaasCluster)
 	}
 }
 
@@ -84,54 +129,39 @@ func findMatchingOpaasClusterWithResourcePool(resourcePool Cluster, opaasData *c
 		"resourcePoolName": resourcePool.PoolName,
 	}
 	logrus.WithFields(logFields).Info("Searching for cluster in opaas that matches vcenter resource pool")
-	for _, opaasCluster := range opaasData.Clusters {
-		if clusterMatchesResourcePool(resourcePool, opaasCluster) {
-			logrus.WithFields(logFields).Info("Found cluster in opaas that matches vcenter resource pool")
-			return &opaasCluster
-		}
+	clusterPodInt, atoiErr := strconv.Atoi(resourcePool.Pod)
+	if atoiErr != nil {
+		logrus.WithFields(logrus.Fields{
+			"pod":   resourcePool.Pod,
+			"Error": atoiErr.Error(),
+		}).Error("Unable to convert ascii pod value to integer")
+		return nil
+	}
+	opaasCluster := opaasData.ClusterByResourcePool(resourcePool.SiteID, clusterPodInt, resourcePool.Datacenter, resourcePool.PoolName)
+	if opaasCluster != nil {
+		logrus.WithFields(logFields).Info("Found cluster in opaas that matches vcenter resource pool")
+		return opaasCluster
 	}
 	logrus.WithFields(logFields).Info("Unable to find cluster in opaas that matches vcenter resource pool")
 	return nil
 }
 
-func findMatchingOpaasClusterWithCluster(cluster Cluster, opaasClusters []client.Cluster) *client.Cluster {
+func findMatchingOpaasClusterWithCluster(cluster Cluster, opaasData *client.OpaasData) *client.Cluster {
 	logFields := logrus.Fields{
 		"site":        cluster.SiteID,
 		"datacenter":  cluster.Datacenter,
 		"clusterName": cluster.EsxName,
 	}
 	logrus.WithFields(logFields).Info("Searching for cluster in opaas that matches vcenter cluster")
-	for _, opaasCluster := range opaasClusters {
-		if clusterMatchesCluster(opaasCluster, cluster) {
-			logrus.WithFields(logFields).Info("Found cluster in opaas that matches vcenter cluster")
-			return &opaasCluster
-		}
+	opaasCluster := opaasData.ClusterByName(cluster.SiteID, cluster.Datacenter, cluster.EsxName)
+	if opaasCluster != nil {
+		logrus.WithFields(logFields).Info("Found cluster in opaas that matches vcenter cluster")
+		return opaasCluster
 	}
 	logrus.WithFields(logFields).Info("Unable to find cluster in opaas that matches vcenter cluster")
 	return nil
 }
 
-func clusterMatchesResourcePool(resourcePool Cluster, opaasCluster client.Cluster) bool {
-	clusterPodInt, atoiErr := strconv.Atoi(resourcePool.Pod)
-	if atoiErr != nil {
-		logrus.WithFields(logrus.Fields{
-			"pod":   resourcePool.Pod,
-			"Error": atoiErr.Error(),
-		}).Error("Unable to convert ascii pod value to integer")
-		return false
-	}
-	return opaasCluster.PoolLocation == resourcePool.SiteID &&
-		opaasCluster.Pod == clusterPodInt &&
-		opaasCluster.Datacenter == resourcePool.Datacenter &&
-		opaasCluster.ResourcePoolName == resourcePool.PoolName
-}
-
-func clusterMatchesCluster(opaasCluster client.Cluster, cluster Cluster) bool {
-	return opaasCluster.PoolLocation == cluster.SiteID &&
-		opaasCluster.Datacenter == cluster.Datacenter &&
-		opaasCluster.ClusterName == cluster.EsxName
-}
-
 func sendClusterSlackMessage(cluster Cluster, profile string) {
 	slackParams := &utils.SlackParams{
 		EsxName:                cluster.EsxName,
@@ -151,7 +181,7 @@ func sendClusterSlackMessage(cluster Cluster, profile string) {
 	utils.SendSlackMessage(slackParams)
 }
 
-func patchClusterIfNecessary(cluster Cluster, opaasCluster *client.Cluster) {
+func patchClusterIfNecessary(batch *patchBatch, cluster Cluster, opaasCluster *client.Cluster) {
 	patches := createNecessaryClusterPatches(cluster, opaasCluster)
 	logFields := logrus.Fields{
 		"patches":          patches,
@@ -163,16 +193,22 @@ func patchClusterIfNecessary(cluster Cluster, opaasCluster *client.Cluster) {
 		return
 	}
 	logrus.WithFields(logFields).Info("Patching cluster")
-	patchCluster(opaasCluster.ID, patches)
+	if utils.IsDryRun() {
+		recordDryRunPatches(batch.partition, batch.offset, "cluster", opaasCluster.ID, opaasCluster.ClusterName, patches)
+		return
+	}
+	batch.add("cluster", client.NewClusterPatchRequest(opaasCluster.ID, patches), func() {
+		applyClusterPatches(cluster, opaasCluster, patches)
+	})
 }
 
 func createNecessaryClusterPatches(cluster Cluster, opaasCluster *client.Cluster) []client.Patch {
 	patches := []client.Patch{}
 	if cpuPatchIsNecessary(cluster, opaasCluster) {
-		patches = append(patches, createCPUPatch(cluster))
+		patches = append(patches, createCPUPatches(cluster, opaasCluster)...)
 	}
 	if memoryPatchIsNecessary(cluster, opaasCluster) {
-		patches = append(patches, createMemoryPatch(cluster))
+		patches = append(patches, createMemoryPatches(cluster, opaasCluster)...)
 	}
 	return patches
 }
@@ -187,32 +223,24 @@ func memoryPatchIsNecessary(cluster Cluster, opaasCluster *client.Cluster) bool
 		opaasCluster.VCenterMemoryConsumed != cluster.MemoryRequested
 }
 
-func createCPUPatch(cluster Cluster) client.Patch {
-	return client.Patch{
-		Op:    "replace",
-		Path:  "/vCenterCpuConsumed",
-		Value: cluster.CPURequested,
-	}
+func createCPUPatches(cluster Cluster, opaasCluster *client.Cluster) []client.Patch {
+	return client.GuardedReplacePatches(vcenter_cpu_path, opaasCluster.VCenterCPUConsumed, cluster.CPURequested)
 }
 
-func createMemoryPatch(cluster Cluster) client.Patch {
-	return client.Patch{
-		Op:    "replace",
-		Path:  "/vCenterMemoryConsumed",
-		Value: cluster.MemoryRequested,
-	}
+func createMemoryPatches(cluster Cluster, opaasCluster *client.Cluster) []client.Patch {
+	return client.GuardedReplacePatches(vcenter_memory_path, opaasCluster.VCenterMemoryConsumed, cluster.MemoryRequested)
 }
 
-func patchCluster(clusterID string, patches []client.Patch) {
-	opaasAPI := client.NewOpaasApi()
-	clusterPatchErr := opaasAPI.PatchCluster(clusterID, patches)
-	if clusterPatchErr != nil {
-		logrus.WithFields(logrus.Fields{
-			"Error": clusterPatchErr.Error(),
-		}).Error("Failed to patch cluster")
-	} else {
-		logrus.WithFields(logrus.Fields{
-			"clusterID": clusterID,
-		}).Info("Successfully patched cluster")
+func applyClusterPatches(cluster Cluster, opaasCluster *client.Cluster, patches []client.Patch) {
+	for _, patch := range patches {
+		if patch.Op != client.PatchReplace {
+			continue
+		}
+		switch patch.Path {
+		case vcenter_cpu_path:
+			opaasCluster.VCenterCPUConsumed = cluster.CPURequested
+		case vcenter_memory_path:
+			opaasCluster.VCenterMemoryConsumed = cluster.MemoryRequested
+		}
 	}
 }
@@ -2,10 +2,19 @@ package events
 
 import (
 	"errors"
+	"github.com/opaas/capacity-worker/aliases"
 	"github.com/opaas/capacity-worker/client"
+	"github.com/opaas/capacity-worker/inventory"
+	"github.com/opaas/capacity-worker/softlayer"
 	"github.com/opaas/capacity-worker/utils"
 	"github.com/sirupsen/logrus"
 	"strconv"
+	"time"
+)
+
+const (
+	server_id_audit_file string = "output/ServerIdChanges.csv"
+	dry_run_create_op    string = "create"
 )
 
 type ClusterHostEvent struct {
@@ -19,15 +28,39 @@ type ClusterHost struct {
 	POD         string `json:"PODID"`
 	CLUSTERNAME string `json:"ESXNAME"`
 	DATACENTER  string `json:"DATACENTER"`
+	SNAPSHOTID  int    `json:"SNAPSHOT_ID"`
+}
+
+func init() {
+	RegisterHandler(Handler{
+		Schemas: map[int]RecordSchema{
+			1: {
+				RequiredFields: []string{"HOSTNAME", "ESXNAME", "DATACENTER", "PODID"},
+				NewRecord:      func() interface{} { return &ClusterHost{} },
+			},
+		},
+		Decode: func(envelope *Envelope) (Event, error) {
+			event := &ClusterHostEvent{}
+			return event, envelope.Decode(event)
+		},
+	}, "xseries.esx_host")
 }
 
-func (event ClusterHostEvent) Process(offset int64, opaasData *client.OpaasData, SlData []utils.SoftLayerHosts) {
+// Process never fails the message: a failed create is retried on the next
+// snapshot, and a failed server ID patch is sent to Slack to be fixed by hand.
+func (event ClusterHostEvent) Process(partition int, offset int64, opaasData *client.OpaasData, SlData *softlayer.Data) error {
+	clusterhostProcessing.Lock()
+	defer clusterhostProcessing.Unlock()
 	for _, clusterhost := range event.Data {
-		processClusterhost(clusterhost, opaasData, SlData)
+		processClusterhost(partition, offset, clusterhost, opaasData, SlData)
 	}
+	saveClusterhostSnapshotsIfChanged()
+	return nil
 }
 
-func processClusterhost(clusterhost ClusterHost, opaasData *client.OpaasData, SlData []utils.SoftLayerHosts) {
+func processClusterhost(partition int, offset int64, clusterhost ClusterHost, opaasData *client.OpaasData, SlData *softlayer.Data) {
+	clusterhost.DATACENTER = aliases.Datacenter(clusterhost.DATACENTER)
+	clusterhost.POD = aliases.Pod(clusterhost.POD)
 	cluster := findCluster(clusterhost, opaasData)
 	if cluster == nil {
 		logFields := logrus.Fields{
@@ -39,6 +72,10 @@ func processClusterhost(clusterhost ClusterHost, opaasData *client.OpaasData, Sl
 		logrus.WithFields(logFields).Info("Cannot find matching clustername in Opaas")
 		return
 	}
+	observeClusterhostInSnapshot(partition, offset, clusterhost, cluster, opaasData)
+	if hardware, found := SlData.HardwareByFQDN(clusterhost.HOSTNAME); found {
+		checkClusterhostHardware(clusterhost, cluster, hardware)
+	}
 	if cluster.Profile != "3x" {
 		logFields := logrus.Fields{
 			"clusterHost": clusterhost.HOSTNAME,
@@ -57,49 +94,165 @@ func processClusterhost(clusterhost ClusterHost, opaasData *client.OpaasData, Sl
 	}
 	clusterHost := findClusterhost(clusterhost, opaasData)
 	if clusterHost == nil {
-		addNewClusterhost(clusterhost, cluster, serverId)
+		addNewClusterhost(partition, offset, clusterhost, cluster, serverId)
 	} else {
+		forgetDiscoveredClusterhost(clusterHost.Name)
 		if clusterHost.ServerID != serverId {
-			sendNewServerIDSlackMessage(clusterHost, cluster, serverId)
+			reconcileServerID(partition, offset, clusterHost, cluster, serverId)
 		}
 	}
 }
 
+// reconcileServerID patches a clusterhost whose SoftLayer server ID changed
+// when CAP_SERVER_ID_REMEDIATION is set. Otherwise, or if the patch fails,
+// Slack is asked to have someone fix it by hand.
+func reconcileServerID(partition int, offset int64, clusterHost *client.Clusterhost, cluster *client.Cluster, serverId string) {
+	logFields := logrus.Fields{
+		"clusterHost":   clusterHost.Name,
+		"clusterhostId": clusterHost.ID,
+		"oldServerId":   clusterHost.ServerID,
+		"newServerId":   serverId,
+	}
+	if !utils.GetServerIDRemediation() {
+		sendNewServerIDSlackMessage(clusterHost, cluster, serverId)
+		return
+	}
+	patches := client.GuardedReplacePatches("/serverId", clusterHost.ServerID, serverId)
+	if utils.IsDryRun() {
+		recordDryRunPatches(partition, offset, "clusterhost", clusterHost.ID, clusterHost.Name, patches)
+		return
+	}
+	opaasAPI := client.NewOpaasApi()
+	patchErr := opaasAPI.PatchClusterhost(clusterHost.ID, patches)
+	observePatches(patches, patchErr)
+	if client.IsConflict(patchErr) {
+		inventory.Invalidate(inventory.Clusterhosts)
+	}
+	writeServerIDAudit(clusterHost, serverId, patchErr)
+	if patchErr != nil {
+		logFields["Error"] = patchErr.Error()
+		logrus.WithFields(logFields).Error("Failed to patch clusterhost serverId")
+		sendNewServerIDSlackMessage(clusterHost, cluster, serverId)
+		return
+	}
+	logrus.WithFields(logFields).Info("Successfully patched clusterhost serverId")
+	sendServerIDUpdatedSlackMessage(clusterHost, cluster, serverId)
+	clusterHost.ServerID = serverId
+}
+
+func writeServerIDAudit(clusterHost *client.Clusterhost, serverId string, patchErr error) {
+	result := "applied"
+	if patchErr != nil {
+		result = "failed"
+	}
+	auditRecord := []utils.CSVInfo{
+		utils.ServerIdChangeCSV{
+			Hostname:      clusterHost.Name,
+			ClusterhostId: clusterHost.ID,
+			OldServerId:   clusterHost.ServerID,
+			NewServerId:   serverId,
+			Result:        result,
+		},
+	}
+	csvErr := utils.WriteToCSV(server_id_audit_file, auditRecord)
+	if csvErr != nil {
+		logrus.WithFields(logrus.Fields{
+			"clusterHost": clusterHost.Name,
+			"Error":       csvErr.Error(),
+		}).Error("Failed to write serverId audit trail")
+	}
+}
+
 func findClusterhost(clusterhost ClusterHost, opaasData *client.OpaasData) *client.Clusterhost {
-	for _, hostrecord := range opaasData.Clusterhosts {
-		if hostrecord.Name == clusterhost.HOSTNAME {
-			return &hostrecord
+	return opaasData.ClusterhostByName(clusterhost.HOSTNAME)
+}
+
+// addNewClusterhost creates a host OPaaS does not know about yet. With
+// CAP_CLUSTERHOST_APPROVAL set, a new host is only announced on Slack and is
+// created once it has been approved. Either way Slack hears about each host
+// once, not on every snapshot.
+func addNewClusterhost(partition int, offset int64, clusterhost ClusterHost, cluster *client.Cluster, serverID string) {
+	discovered, isNew, recordErr := recordDiscoveredClusterhost(clusterhost, cluster, serverID, utils.GetClusterhostApproval(), utils.GetClusterhostCreateTimeout())
+	if recordErr != nil {
+		logrus.WithFields(logrus.Fields{
+			"clusterHost": clusterhost.HOSTNAME,
+			"Error":       recordErr.Error(),
+		}).Error("Failed to record discovered clusterhost")
+		return
+	}
+	switch discovered.Status {
+	case ClusterhostCreated:
+		logrus.WithFields(logrus.Fields{
+			"clusterHost": clusterhost.HOSTNAME,
+		}).Info("Clusterhost already created, waiting for it to appear in OPaaS")
+	case ClusterhostPendingApproval:
+		if isNew {
+			sendPendingClusterHostSlackMessage(discovered)
 		}
+	default:
+		createClusterhost(partition, offset, discovered)
 	}
-	return nil
 }
 
-func addNewClusterhost(clusterhost ClusterHost, cluster *client.Cluster, serverID string) {
-	// code to build new cluster-host payload and send to opaas goes here
-	sendAddClusterHostSlackMessage(cluster, clusterhost, serverID)
+// createClusterhost records the create in dry-run mode, with the record that
+// would be sent as the new value.
+func createClusterhost(partition int, offset int64, discovered DiscoveredClusterhost) {
+	logFields := logrus.Fields{
+		"clusterHost": discovered.HostName,
+		"serverId":    discovered.ServerID,
+		"clusterId":   discovered.ClusterID,
+	}
+	newClusterhost := client.Clusterhost{
+		Name:          discovered.HostName,
+		ServerID:      discovered.ServerID,
+		ClusterID:     discovered.ClusterID,
+		WorkloadTypes: discovered.WorkloadTypes,
+	}
+	if utils.IsDryRun() {
+		utils.RecordDryRunPatch(utils.DryRunPatch{
+			Timestamp:  time.Now(),
+			Partition:  partition,
+			Offset:     offset,
+			Model:      "clusterhost",
+			TargetName: discovered.HostName,
+			Op:         dry_run_create_op,
+			Path:       "/",
+			NewValue:   newClusterhost,
+		})
+		return
+	}
+	opaasAPI := client.NewOpaasApi()
+	_, createErr := opaasAPI.CreateClusterhost(newClusterhost)
+	if createErr != nil {
+		logFields["Error"] = createErr.Error()
+		logrus.WithFields(logFields).Error("Failed to create clusterhost, will retry on the next snapshot")
+		return
+	}
+	inventory.Invalidate(inventory.Clusterhosts)
+	logrus.WithFields(logFields).Info("Created clusterhost")
+	statusErr := setDiscoveredClusterhostStatus(discovered.HostName, ClusterhostCreated)
+	if statusErr != nil {
+		logFields["Error"] = statusErr.Error()
+		logrus.WithFields(logFields).Error("Failed to record created clusterhost")
+	}
+	sendAddClusterHostSlackMessage(discovered)
 }
 
+// findCluster only accepts a POD written the way OPaaS pods print, so "07"
+// or "+7" do not match pod 7; the pod aliases translate those.
 func findCluster(clusterhost ClusterHost, opaasData *client.OpaasData) *client.Cluster {
-	for _, cluster := range opaasData.Clusters {
-		if cluster.ClusterName == clusterhost.CLUSTERNAME {
-			if cluster.Datacenter == clusterhost.DATACENTER {
-				if strconv.Itoa(cluster.Pod) == clusterhost.POD {
-					return &cluster
-				}
-			}
-		}
+	pod, atoiErr := strconv.Atoi(clusterhost.POD)
+	if atoiErr != nil || strconv.Itoa(pod) != clusterhost.POD {
+		return nil
 	}
-	return nil
+	return opaasData.ClusterForClusterhost(clusterhost.DATACENTER, pod, clusterhost.CLUSTERNAME)
 }
 
-func findServerID(clusterhost ClusterHost, SlData []utils.SoftLayerHosts) (error, string) {
-	var err error = nil
-	for _, slHost := range SlData {
-		if slHost.FQDN == clusterhost.HOSTNAME {
-			return err, strconv.Itoa(slHost.ID)
-		}
+func findServerID(clusterhost ClusterHost, SlData *softlayer.Data) (error, string) {
+	if serverID, found := SlData.ServerID(clusterhost.HOSTNAME); found {
+		return nil, strconv.Itoa(serverID)
 	}
-	err = errors.New("No match in Slack Data for clusterhost.HOSTNAME")
+	err := errors.New("No match in Slack Data for clusterhost.HOSTNAME")
 	return err, clusterhost.HOSTNAME
 }
 
@@ -113,13 +266,30 @@ func sendNewServerIDSlackMessage(clusterHost *client.Clusterhost, cluster *clien
 	utils.SendNewServerIdSlackMessage(slackCHParams)
 }
 
-func sendAddClusterHostSlackMessage(cluster *client.Cluster, clusterhost ClusterHost, serverID string) {
+func sendServerIDUpdatedSlackMessage(clusterHost *client.Clusterhost, cluster *client.Cluster, serverId string) {
 	slackCHParams := &utils.SlackCHParams{
-		Hostname:      clusterhost.HOSTNAME,
-		ServerId:      serverID,
-		WorkloadTypes: cluster.WorkloadTypes,
-		ClusterId:     cluster.ID,
-		Profile:       cluster.Profile,
+		Hostname:    clusterHost.Name,
+		ServerId:    serverId,
+		OldServerId: clusterHost.ServerID,
+		Profile:     cluster.Profile,
+	}
+	utils.SendServerIdUpdatedSlackMessage(slackCHParams)
+}
+
+func sendAddClusterHostSlackMessage(discovered DiscoveredClusterhost) {
+	utils.SendAddClusterHostSlackMessage(discoveredSlackCHParams(discovered))
+}
+
+func sendPendingClusterHostSlackMessage(discovered DiscoveredClusterhost) {
+	utils.SendPendingClusterHostSlackMessage(discoveredSlackCHParams(discovered))
+}
+
+func discoveredSlackCHParams(discovered DiscoveredClusterhost) *utils.SlackCHParams {
+	return &utils.SlackCHParams{
+		Hostname:      discovered.HostName,
+		ServerId:      discovered.ServerID,
+		WorkloadTypes: discovered.WorkloadTypes,
+		ClusterId:     discovered.ClusterID,
+		Profile:       discovered.Profile,
 	}
-	utils.SendAddClusterHostSlackMessage(slackCHParams)
 }
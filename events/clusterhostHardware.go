@@ -0,0 +1,91 @@
+package events
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/opaas/capacity-worker/aliases"
+	"github.com/opaas/capacity-worker/client"
+	"github.com/opaas/capacity-worker/metrics"
+	"github.com/opaas/capacity-worker/softlayer"
+	"github.com/opaas/capacity-worker/utils"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	datacenter_mismatch string = "datacenter"
+	hardware_mismatch   string = "hardware"
+)
+
+// alertedMismatches holds the last mismatch sent to Slack per host and kind,
+// so a host is announced once rather than on every snapshot. It is reset when
+// the worker restarts.
+var (
+	alertedMismatchMutex sync.Mutex
+	alertedMismatches    = make(map[string]string)
+)
+
+// checkClusterhostHardware compares a clusterhost with its SoftLayer
+// hardware: the datacenter, aliased like vCenter's, against the one vCenter
+// reports, and the cores and memory against what OPaaS expects for the
+// cluster's profile.
+func checkClusterhostHardware(clusterhost ClusterHost, cluster *client.Cluster, hardware *softlayer.Hardware) {
+	slDatacenter := aliases.Datacenter(hardware.DatacenterName())
+	if slDatacenter != "" && !strings.EqualFold(slDatacenter, clusterhost.DATACENTER) {
+		reportHardwareMismatch(datacenter_mismatch, clusterhost, cluster, hardware, clusterhost.DATACENTER, slDatacenter)
+	}
+	coresDiffer := cluster.HostCores != 0 && cluster.HostCores != hardware.ProcessorCores
+	memoryDiffers := cluster.HostMemoryGB != 0 && cluster.HostMemoryGB != hardware.MemoryGB
+	if coresDiffer || memoryDiffers {
+		expected := formatHardwareSpec(cluster.HostCores, cluster.HostMemoryGB)
+		actual := formatHardwareSpec(hardware.ProcessorCores, hardware.MemoryGB)
+		reportHardwareMismatch(hardware_mismatch, clusterhost, cluster, hardware, expected, actual)
+	}
+}
+
+func formatHardwareSpec(cores int, memoryGB int) string {
+	return fmt.Sprintf("%d cores, %d GB", cores, memoryGB)
+}
+
+func reportHardwareMismatch(kind string, clusterhost ClusterHost, cluster *client.Cluster, hardware *softlayer.Hardware, expected string, actual string) {
+	metrics.ClusterhostMismatches.WithLabelValues(kind).Inc()
+	logrus.WithFields(logrus.Fields{
+		"clusterHost":    clusterhost.HOSTNAME,
+		"serverId":       hardware.ID,
+		"profile":        cluster.Profile,
+		"mismatch":       kind,
+		"expected":       expected,
+		"softLayer":      actual,
+		"hardwareStatus": hardware.Status(),
+		"primaryIp":      hardware.PrimaryIP,
+	}).Warn("Clusterhost does not match its SoftLayer hardware")
+	if !firstMismatchAlert(clusterhost.HOSTNAME, kind, expected+"|"+actual) {
+		return
+	}
+	slackCHParams := &utils.SlackCHParams{
+		Hostname:  clusterhost.HOSTNAME,
+		ServerId:  strconv.Itoa(hardware.ID),
+		ClusterId: cluster.ID,
+		Profile:   cluster.Profile,
+		Expected:  expected,
+		Actual:    actual,
+	}
+	if kind == datacenter_mismatch {
+		utils.SendDatacenterMismatchSlackMessage(slackCHParams)
+	} else {
+		utils.SendHardwareMismatchSlackMessage(slackCHParams)
+	}
+}
+
+func firstMismatchAlert(hostName string, kind string, mismatch string) bool {
+	key := hostName + "|" + kind
+	alertedMismatchMutex.Lock()
+	defer alertedMismatchMutex.Unlock()
+	if alertedMismatches[key] == mismatch {
+		return false
+	}
+	alertedMismatches[key] = mismatch
+	return true
+}
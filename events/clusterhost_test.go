@@ -0,0 +1,55 @@
+package events
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/opaas/capacity-worker/client"
+)
+
+// scanCluster is the lookup findCluster replaced.
+func scanCluster(clusterhost ClusterHost, clusters []client.Cluster) string {
+	for _, cluster := range clusters {
+		if cluster.ClusterName == clusterhost.CLUSTERNAME &&
+			cluster.Datacenter == clusterhost.DATACENTER &&
+			strconv.Itoa(cluster.Pod) == clusterhost.POD {
+			return cluster.ID
+		}
+	}
+	return ""
+}
+
+func TestFindClusterMatchesLinearScan(t *testing.T) {
+	opaasData := client.NewOpaasData(nil, nil, []client.Cluster{
+		{ID: "c0", Datacenter: "pok02", Pod: 7, ClusterName: "esx1"},
+		{ID: "c1", Datacenter: "pok02", Pod: 7, ClusterName: "esx1"},
+		{ID: "c2", Datacenter: "pok02", Pod: 0, ClusterName: "esx1"},
+		{ID: "c3", Datacenter: "dal10", Pod: 7, ClusterName: "esx1"},
+	}, nil)
+	tests := []struct {
+		name string
+		pod  string
+	}{
+		{name: "pod as printed", pod: "7"},
+		{name: "zero pod", pod: "0"},
+		{name: "leading zero", pod: "07"},
+		{name: "plus sign", pod: "+7"},
+		{name: "negative zero", pod: "-0"},
+		{name: "surrounding space", pod: " 7"},
+		{name: "not a number", pod: "seven"},
+		{name: "empty", pod: ""},
+		{name: "unknown pod", pod: "8"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clusterhost := ClusterHost{CLUSTERNAME: "esx1", DATACENTER: "pok02", POD: test.pod}
+			got := ""
+			if cluster := findCluster(clusterhost, opaasData); cluster != nil {
+				got = cluster.ID
+			}
+			if want := scanCluster(clusterhost, opaasData.Clusters); got != want {
+				t.Errorf("findCluster(POD %q) = %q, want %q", test.pod, got, want)
+			}
+		})
+	}
+}
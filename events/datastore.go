@@ -1,7 +1,9 @@
 package events
 
 import (
+	"github.com/opaas/capacity-worker/aliases"
 	"github.com/opaas/capacity-worker/client"
+	"github.com/opaas/capacity-worker/softlayer"
 	"github.com/opaas/capacity-worker/utils"
 	"github.com/sirupsen/logrus"
 )
@@ -28,22 +30,47 @@ type Datastore struct {
 	SITEID        string `json:"SITE_ID"`
 }
 
-func (event DatastoreEvent) Process(offset int64, opaasData *client.OpaasData, SlData []utils.SoftLayerHosts) {
+func init() {
+	RegisterHandler(Handler{
+		Schemas: map[int]RecordSchema{
+			1: {
+				RequiredFields: []string{"DATASTORE_NAME", "SITE_ID", "REQUESTED_GB"},
+				NewRecord:      func() interface{} { return &Datastore{} },
+			},
+		},
+		Decode: func(envelope *Envelope) (Event, error) {
+			event := &DatastoreEvent{}
+			return event, envelope.Decode(event)
+		},
+	}, "xseries.datastore")
+}
+
+// Process writes the CSV only once the patches were sent, so a message that
+// is retried is not written twice.
+func (event DatastoreEvent) Process(partition int, offset int64, opaasData *client.OpaasData, SlData *softlayer.Data) error {
 	datastoreCSVs := []utils.CSVInfo{}
+	batch := newPatchBatch(partition, offset)
 	for _, datastore := range event.Data {
-		datastoreCSV := processDatastore(datastore, opaasData)
+		datastoreCSV := processDatastore(batch, datastore, opaasData)
 		datastoreCSVs = append(datastoreCSVs, datastoreCSV)
 	}
+	sendErr := batch.send()
+	if sendErr != nil {
+		return sendErr
+	}
 	writeDatastoreCSV(offset, datastoreCSVs)
+	return nil
 }
 
-func processDatastore(datastore Datastore, opaasData *client.OpaasData) *utils.DatastoreCSV {
-	datastore.SITEID = mapSites(datastore.SITEID)
+func processDatastore(batch *patchBatch, datastore Datastore, opaasData *client.OpaasData) *utils.DatastoreCSV {
+	datastore.SITEID = mapSites(datastore.SITEID, opaasData)
+	datastore.DATACENTER = aliases.Datacenter(datastore.DATACENTER)
+	datastore.PODID = aliases.Pod(datastore.PODID)
 	datastoreCSV := createDatastoreCSV(datastore)
 	opaasStorage := findAppropriateStorage(datastore, opaasData)
 	if opaasStorage != nil {
 		addOpaasStorageCSVInfo(opaasStorage, datastoreCSV)
-		patchDatastoreIfNecessary(datastore, opaasStorage)
+		patchDatastoreIfNecessary(batch, datastore, opaasStorage)
 	}
 	return datastoreCSV
 }
@@ -53,7 +80,7 @@ func findAppropriateStorage(datastore Datastore, opaasData *client.OpaasData) *c
 	if storage == nil {
 		return nil
 	}
-	if !clusterExistsAtCorrectSite(datastore, storage, opaasData.Clusters) {
+	if !clusterExistsAtCorrectSite(datastore, storage, opaasData) {
 		return nil
 	}
 	return storage
@@ -64,28 +91,17 @@ func findMatchingStorage(datastore Datastore, opaasData *client.OpaasData) *clie
 		"datastoreName": datastore.DATASTORENAME,
 	}
 	logrus.WithFields(logFields).Info("Searching for matching storage")
-	for _, storage := range opaasData.Storage {
-		if storage.Name == datastore.DATASTORENAME {
-			logrus.WithFields(logFields).Info("Found matching storage")
-			return &storage
-		}
+	if storage := opaasData.StorageByName(datastore.DATASTORENAME); storage != nil {
+		logrus.WithFields(logFields).Info("Found matching storage")
+		return storage
 	}
 	logrus.WithFields(logFields).Info("Failed to find matching storage")
 	return nil
 }
 
-func clusterExistsAtCorrectSite(datastore Datastore, storage *client.Storage, clusters []client.Cluster) bool {
-	for _, cluster := range clusters {
-		if cluster.PoolLocation == datastore.SITEID && storageIsAssociatedWithCluster(storage, &cluster) {
-			return true
-		}
-	}
-	return false
-}
-
-func storageIsAssociatedWithCluster(opaasStorage *client.Storage, cluster *client.Cluster) bool {
-	for _, id := range cluster.StorageIds {
-		if id == opaasStorage.ID {
+func clusterExistsAtCorrectSite(datastore Datastore, storage *client.Storage, opaasData *client.OpaasData) bool {
+	for _, cluster := range opaasData.ClustersWithStorage(storage.ID) {
+		if cluster.PoolLocation == datastore.SITEID {
 			return true
 		}
 	}
@@ -111,7 +127,7 @@ func addOpaasStorageCSVInfo(opaasStorage *client.Storage, datastoreCSV *utils.Da
 	datastoreCSV.SizeConsumed = opaasStorage.SizeConsumed
 }
 
-func patchDatastoreIfNecessary(dataStore Datastore, opaasStorage *client.Storage) {
+func patchDatastoreIfNecessary(batch *patchBatch, dataStore Datastore, opaasStorage *client.Storage) {
 	patches := createNecessaryDatastorePatches(dataStore, opaasStorage)
 	logFields := logrus.Fields{
 		"patches":      patches,
@@ -123,13 +139,19 @@ func patchDatastoreIfNecessary(dataStore Datastore, opaasStorage *client.Storage
 		return
 	}
 	logrus.WithFields(logFields).Info("Patching storage")
-	patchStorage(opaasStorage.ID, patches)
+	if utils.IsDryRun() {
+		recordDryRunPatches(batch.partition, batch.offset, "storage", opaasStorage.ID, opaasStorage.Name, patches)
+		return
+	}
+	batch.add("storage", client.NewStoragePatchRequest(opaasStorage.ID, patches), func() {
+		opaasStorage.VCenterSizeConsumed = dataStore.REQUESTEDGB
+	})
 }
 
 func createNecessaryDatastorePatches(datastore Datastore, opaasStorage *client.Storage) []client.Patch {
 	patches := []client.Patch{}
 	if storagePatchIsNecessary(datastore, opaasStorage) {
-		patches = append(patches, createStoragePatch(datastore))
+		patches = append(patches, createStoragePatches(datastore, opaasStorage)...)
 	}
 	return patches
 }
@@ -139,26 +161,8 @@ func storagePatchIsNecessary(datastore Datastore, opaasStorage *client.Storage)
 		opaasStorage.VCenterSizeConsumed != datastore.REQUESTEDGB
 }
 
-func createStoragePatch(datastore Datastore) client.Patch {
-	return client.Patch{
-		Op:    "replace",
-		Path:  "/vCenterSizeConsumed",
-		Value: datastore.REQUESTEDGB,
-	}
-}
-
-func patchStorage(storageID string, patches []client.Patch) {
-	opaasAPI := client.NewOpaasApi()
-	storagePatchErr := opaasAPI.PatchStorage(storageID, patches)
-	if storagePatchErr != nil {
-		logrus.WithFields(logrus.Fields{
-			"Error": storagePatchErr.Error(),
-		}).Error("Failed to patch storages")
-	} else {
-		logrus.WithFields(logrus.Fields{
-			"storageId": storageID,
-		}).Info("Successfully patched storage")
-	}
+func createStoragePatches(datastore Datastore, opaasStorage *client.Storage) []client.Patch {
+	return client.GuardedReplacePatches("/vCenterSizeConsumed", opaasStorage.VCenterSizeConsumed, datastore.REQUESTEDGB)
 }
 
 func writeDatastoreCSV(offset int64, datastoreCSV []utils.CSVInfo) {
@@ -0,0 +1,198 @@
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/opaas/capacity-worker/client"
+	"github.com/opaas/capacity-worker/utils"
+	"github.com/sirupsen/logrus"
+)
+
+const discovered_clusterhost_file string = "output/discoveredClusterhosts.json"
+
+const (
+	ClusterhostPendingApproval string = "pending-approval"
+	ClusterhostApproved        string = "approved"
+	ClusterhostCreated         string = "created"
+)
+
+var ErrClusterhostNotPending = errors.New("Clusterhost is not pending approval")
+
+// DiscoveredClusterhost is a 3x ESX host seen in a snapshot that OPaaS does
+// not know about yet. It is kept until the host shows up in the OPaaS
+// inventory, so each host is announced and created only once.
+type DiscoveredClusterhost struct {
+	HostName      string    `json:"hostName"`
+	ServerID      string    `json:"serverId"`
+	ClusterID     string    `json:"clusterId"`
+	WorkloadTypes []string  `json:"workloadTypes"`
+	Profile       string    `json:"profile"`
+	Status        string    `json:"status"`
+	DiscoveredAt  time.Time `json:"discoveredAt"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+var (
+	discoveredMutex        sync.Mutex
+	discoveredClusterhosts map[string]*DiscoveredClusterhost
+)
+
+// recordDiscoveredClusterhost returns the stored entry for the host, creating
+// it when the host is new. New hosts start out pending approval when
+// CAP_CLUSTERHOST_APPROVAL is set and approved otherwise. A host created more
+// than createTimeout ago that OPaaS still does not list is approved again, so
+// it is created again.
+func recordDiscoveredClusterhost(clusterhost ClusterHost, cluster *client.Cluster, serverID string, requireApproval bool, createTimeout time.Duration) (DiscoveredClusterhost, bool, error) {
+	discoveredMutex.Lock()
+	defer discoveredMutex.Unlock()
+	loadErr := loadDiscoveredClusterhosts()
+	if loadErr != nil {
+		return DiscoveredClusterhost{}, false, loadErr
+	}
+	discovered, found := discoveredClusterhosts[clusterhost.HOSTNAME]
+	if found && discovered.Status == ClusterhostCreated {
+		if time.Since(discovered.CreatedAt) < createTimeout {
+			return *discovered, false, nil
+		}
+		logrus.WithFields(logrus.Fields{
+			"clusterHost": clusterhost.HOSTNAME,
+			"createdAt":   discovered.CreatedAt,
+		}).Warn("Created clusterhost never appeared in OPaaS, creating it again")
+		discovered.Status = ClusterhostApproved
+	}
+	if !found {
+		discovered = &DiscoveredClusterhost{
+			HostName:     clusterhost.HOSTNAME,
+			Status:       ClusterhostApproved,
+			DiscoveredAt: time.Now(),
+		}
+		if requireApproval {
+			discovered.Status = ClusterhostPendingApproval
+		}
+		discoveredClusterhosts[clusterhost.HOSTNAME] = discovered
+	}
+	discovered.ServerID = serverID
+	discovered.ClusterID = cluster.ID
+	discovered.WorkloadTypes = cluster.WorkloadTypes
+	discovered.Profile = cluster.Profile
+	return *discovered, !found, saveDiscoveredClusterhosts()
+}
+
+func setDiscoveredClusterhostStatus(hostName string, status string) error {
+	discoveredMutex.Lock()
+	defer discoveredMutex.Unlock()
+	loadErr := loadDiscoveredClusterhosts()
+	if loadErr != nil {
+		return loadErr
+	}
+	discovered, found := discoveredClusterhosts[hostName]
+	if !found {
+		return fmt.Errorf("Clusterhost %s was never discovered", hostName)
+	}
+	discovered.Status = status
+	if status == ClusterhostCreated {
+		discovered.CreatedAt = time.Now()
+	}
+	return saveDiscoveredClusterhosts()
+}
+
+// forgetDiscoveredClusterhost drops a host once OPaaS lists it.
+func forgetDiscoveredClusterhost(hostName string) {
+	discoveredMutex.Lock()
+	defer discoveredMutex.Unlock()
+	if loadDiscoveredClusterhosts() != nil {
+		return
+	}
+	if _, found := discoveredClusterhosts[hostName]; !found {
+		return
+	}
+	delete(discoveredClusterhosts, hostName)
+	saveErr := saveDiscoveredClusterhosts()
+	if saveErr != nil {
+		logrus.WithFields(logrus.Fields{
+			"clusterHost": hostName,
+			"Error":       saveErr.Error(),
+		}).Error("Failed to update discovered clusterhosts")
+	}
+}
+
+// PendingClusterhosts lists the hosts waiting for approval, oldest first.
+func PendingClusterhosts() ([]DiscoveredClusterhost, error) {
+	discoveredMutex.Lock()
+	defer discoveredMutex.Unlock()
+	loadErr := loadDiscoveredClusterhosts()
+	if loadErr != nil {
+		return nil, loadErr
+	}
+	pending := []DiscoveredClusterhost{}
+	for _, discovered := range discoveredClusterhosts {
+		if discovered.Status == ClusterhostPendingApproval {
+			pending = append(pending, *discovered)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].DiscoveredAt.Before(pending[j].DiscoveredAt)
+	})
+	return pending, nil
+}
+
+// ApproveClusterhost marks a pending host as approved. It is created in
+// OPaaS the next time it appears in a snapshot.
+func ApproveClusterhost(hostName string) error {
+	discoveredMutex.Lock()
+	defer discoveredMutex.Unlock()
+	loadErr := loadDiscoveredClusterhosts()
+	if loadErr != nil {
+		return loadErr
+	}
+	discovered, found := discoveredClusterhosts[hostName]
+	if !found || discovered.Status != ClusterhostPendingApproval {
+		return fmt.Errorf("%s: %w", hostName, ErrClusterhostNotPending)
+	}
+	discovered.Status = ClusterhostApproved
+	logrus.WithFields(logrus.Fields{
+		"clusterHost": hostName,
+	}).Info("Clusterhost approved")
+	return saveDiscoveredClusterhosts()
+}
+
+func loadDiscoveredClusterhosts() error {
+	if discoveredClusterhosts != nil {
+		return nil
+	}
+	discoveredClusterhosts = make(map[string]*DiscoveredClusterhost)
+	data, readErr := ioutil.ReadFile(discovered_clusterhost_file)
+	if os.IsNotExist(readErr) {
+		return nil
+	}
+	if readErr != nil {
+		discoveredClusterhosts = nil
+		return readErr
+	}
+	unmarshalErr := json.Unmarshal(data, &discoveredClusterhosts)
+	if unmarshalErr != nil {
+		discoveredClusterhosts = nil
+		return unmarshalErr
+	}
+	return nil
+}
+
+func saveDiscoveredClusterhosts() error {
+	data, marshalErr := json.MarshalIndent(discoveredClusterhosts, "", "  ")
+	if marshalErr != nil {
+		return marshalErr
+	}
+	mkdirErr := os.MkdirAll(filepath.Dir(discovered_clusterhost_file), 0755)
+	if mkdirErr != nil {
+		return mkdirErr
+	}
+	return utils.WriteFileAtomic(discovered_clusterhost_file, data, 0644)
+}
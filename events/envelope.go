@@ -0,0 +1,143 @@
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/opaas/capacity-worker/metrics"
+	"github.com/opaas/capacity-worker/utils"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	default_schema_version int    = 1
+	quarantine_file        string = "output/quarantinedRecords.jsonl"
+)
+
+// Envelope is the part of every vCenter capacity message that is common to all
+// streams. Producers may set schemaVersion to change the shape of the records
+// in data; messages without it are treated as version 1.
+type Envelope struct {
+	StreamName    string            `json:"streamName"`
+	SchemaVersion int               `json:"schemaVersion,omitempty"`
+	Data          []json.RawMessage `json:"data"`
+}
+
+type RecordRejection struct {
+	Index   int             `json:"index"`
+	Reasons []string        `json:"reasons"`
+	Record  json.RawMessage `json:"record"`
+}
+
+type quarantinedRecord struct {
+	Timestamp     time.Time       `json:"timestamp"`
+	Offset        int64           `json:"offset"`
+	StreamName    string          `json:"streamName"`
+	SchemaVersion int             `json:"schemaVersion"`
+	Index         int             `json:"index"`
+	Reasons       []string        `json:"reasons"`
+	Record        json.RawMessage `json:"record"`
+}
+
+func DecodeEnvelope(payload []byte) (*Envelope, error) {
+	envelope := &Envelope{}
+	unmarshalErr := json.Unmarshal(payload, envelope)
+	if unmarshalErr != nil {
+		return nil, unmarshalErr
+	}
+	if envelope.StreamName == "" {
+		return nil, errors.New("Message has no streamName")
+	}
+	if envelope.SchemaVersion == 0 {
+		envelope.SchemaVersion = default_schema_version
+	}
+	return envelope, nil
+}
+
+// Validate removes the records that are missing a required field or do not
+// match the stream's record type and returns why each one was rejected. An
+// error means the message as a whole cannot be processed.
+func (envelope *Envelope) Validate(schemas map[int]RecordSchema) ([]RecordRejection, error) {
+	schema, found := schemas[envelope.SchemaVersion]
+	if !found {
+		return nil, fmt.Errorf("Unsupported schemaVersion %d for streamName %s", envelope.SchemaVersion, envelope.StreamName)
+	}
+	if envelope.Data == nil {
+		return nil, errors.New("Message has no data")
+	}
+	validRecords := []json.RawMessage{}
+	rejections := []RecordRejection{}
+	for i, record := range envelope.Data {
+		reasons := validateRecord(schema, record)
+		if len(reasons) != 0 {
+			rejections = append(rejections, RecordRejection{
+				Index:   i,
+				Reasons: reasons,
+				Record:  record,
+			})
+			continue
+		}
+		validRecords = append(validRecords, record)
+	}
+	envelope.Data = validRecords
+	return rejections, nil
+}
+
+func validateRecord(schema RecordSchema, record json.RawMessage) []string {
+	fields := map[string]json.RawMessage{}
+	unmarshalErr := json.Unmarshal(record, &fields)
+	if unmarshalErr != nil {
+		return []string{fmt.Sprintf("record is not a JSON object: %s", unmarshalErr.Error())}
+	}
+	reasons := []string{}
+	for _, field := range schema.RequiredFields {
+		value, present := fields[field]
+		if !present || string(value) == "null" {
+			reasons = append(reasons, fmt.Sprintf("missing required field %s", field))
+		}
+	}
+	typeErr := json.Unmarshal(record, schema.NewRecord())
+	if typeErr != nil {
+		reasons = append(reasons, typeErr.Error())
+	}
+	return reasons
+}
+
+// Decode unmarshals the envelope's remaining records into event.
+func (envelope *Envelope) Decode(event Event) error {
+	payload, marshalErr := json.Marshal(envelope)
+	if marshalErr != nil {
+		return marshalErr
+	}
+	return json.Unmarshal(payload, event)
+}
+
+func QuarantineRecords(offset int64, envelope *Envelope, rejections []RecordRejection) {
+	for _, rejection := range rejections {
+		metrics.RejectedRecords.WithLabelValues(envelope.StreamName).Inc()
+		logrus.WithFields(logrus.Fields{
+			"offset":        offset,
+			"streamName":    envelope.StreamName,
+			"schemaVersion": envelope.SchemaVersion,
+			"index":         rejection.Index,
+			"reasons":       rejection.Reasons,
+		}).Warn("Quarantining malformed record")
+		writeErr := utils.AppendJSONLine(quarantine_file, quarantinedRecord{
+			Timestamp:     time.Now(),
+			Offset:        offset,
+			StreamName:    envelope.StreamName,
+			SchemaVersion: envelope.SchemaVersion,
+			Index:         rejection.Index,
+			Reasons:       rejection.Reasons,
+			Record:        rejection.Record,
+		})
+		if writeErr != nil {
+			logrus.WithFields(logrus.Fields{
+				"offset": offset,
+				"Error":  writeErr.Error(),
+			}).Error("Failed to write quarantined record")
+		}
+	}
+}
@@ -1,20 +1,66 @@
 package events
 
 import (
+	"time"
+
+	"github.com/opaas/capacity-worker/aliases"
 	"github.com/opaas/capacity-worker/client"
+	"github.com/opaas/capacity-worker/metrics"
+	"github.com/opaas/capacity-worker/softlayer"
 	"github.com/opaas/capacity-worker/utils"
 )
 
+// Event is one decoded message. Process returns an error, a *PatchError,
+// when OPaaS did not take the message's changes, so the message is not
+// committed as if it had been processed.
 type Event interface {
-	Process(offset int64, opaasData *client.OpaasData, SlData []utils.SoftLayerHosts)
+	Process(partition int, offset int64, opaasData *client.OpaasData, SlData *softlayer.Data) error
+}
+
+// mapSites translates a vCenter site code through the aliases and reports it
+// if neither the aliases nor OPaaS know the result.
+func mapSites(site string, opaasData *client.OpaasData) string {
+	mapped := aliases.Site(site)
+	if !opaasData.HasSite(mapped) && !aliases.IsKnownSite(mapped) {
+		aliases.ReportUnknownSite(site)
+	}
+	return mapped
+}
+
+func observePatches(patches []client.Patch, patchErr error) {
+	for _, patch := range patches {
+		if patch.Op == client.PatchTest {
+			continue
+		}
+		metrics.PatchesIssued.WithLabelValues(patch.Path, metrics.Result(patchErr)).Inc()
+	}
 }
 
-func mapSites(site string) string {
-	if site == "POK1E" {
-		return "POK02"
+// recordDryRunPatches takes the old value of each path from the test
+// operation guarding it, if there is one. Offsets are per partition, so both
+// are recorded.
+func recordDryRunPatches(partition int, offset int64, model string, targetID string, targetName string, patches []client.Patch) {
+	oldValues := make(map[string]interface{})
+	for _, patch := range patches {
+		if patch.Op == client.PatchTest {
+			oldValues[patch.Path] = patch.Value
+		}
 	}
-	if site == "DAL1E" {
-		return "DAL00"
+	for _, patch := range patches {
+		if patch.Op == client.PatchTest {
+			continue
+		}
+		utils.RecordDryRunPatch(utils.DryRunPatch{
+			Timestamp:  time.Now(),
+			Partition:  partition,
+			Offset:     offset,
+			Model:      model,
+			TargetID:   targetID,
+			TargetName: targetName,
+			Op:         patch.Op,
+			Path:       patch.Path,
+			OldValue:   oldValues[patch.Path],
+			NewValue:   patch.Value,
+		})
 	}
-	return site
 }
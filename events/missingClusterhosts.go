@@ -0,0 +1,389 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/opaas/capacity-worker/client"
+	"github.com/opaas/capacity-worker/inventory"
+	"github.com/opaas/capacity-worker/utils"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	clusterhost_snapshot_file string = "output/clusterhostSnapshots.json"
+	missing_clusterhost_file  string = "output/MissingClusterhosts.csv"
+)
+
+// MissingClusterhost is an OPaaS clusterhost whose cluster appeared in a
+// completed snapshot without it.
+type MissingClusterhost struct {
+	ClusterhostID       string `json:"clusterhostId"`
+	HostName            string `json:"hostName"`
+	ServerID            string `json:"serverId"`
+	ClusterID           string `json:"clusterId"`
+	Status              string `json:"status"`
+	FirstMissedSnapshot int    `json:"firstMissedSnapshot"`
+	MissedSnapshots     int    `json:"missedSnapshots"`
+	Reported            bool   `json:"reported"`
+}
+
+// clusterhostSnapshots records which hosts each cluster reported in the
+// snapshots that are still being received, and the hosts missing from earlier
+// snapshots. Records of several snapshots may arrive interleaved, e.g. from
+// different partitions, so a snapshot is only complete once none of its
+// records arrived for CAP_CLUSTERHOST_SNAPSHOT_QUIET_PERIOD.
+type clusterhostSnapshots struct {
+	Reconciled int                            `json:"reconciled"`
+	Open       map[int]*openSnapshot          `json:"open"`
+	Missing    map[string]*MissingClusterhost `json:"missing"`
+}
+
+// openSnapshot remembers where its last record was read, which identifies
+// the hosts it flags in the dry-run report.
+type openSnapshot struct {
+	Seen          map[string]map[string]bool `json:"seen"`
+	LastRecord    time.Time                  `json:"lastRecord"`
+	LastPartition int                        `json:"lastPartition"`
+	LastOffset    int64                      `json:"lastOffset"`
+}
+
+type missingReport struct {
+	missing   MissingClusterhost
+	partition int
+	offset    int64
+}
+
+var (
+	snapshotMutex    sync.Mutex
+	snapshots        *clusterhostSnapshots
+	snapshotsChanged bool
+
+	// clusterhostProcessing keeps the reconciler from reading the inventory's
+	// clusterhosts while a message writes patched values back into them.
+	clusterhostProcessing sync.Mutex
+)
+
+// StartSnapshotReconciler reconciles snapshots that went quiet every half
+// CAP_CLUSTERHOST_SNAPSHOT_QUIET_PERIOD until ctx is done, so the last
+// snapshot before a pause in collection is not left open until the next one.
+func StartSnapshotReconciler(ctx context.Context) {
+	interval := utils.GetClusterhostSnapshotQuietPeriod() / 2
+	if interval <= 0 {
+		interval = utils.GetClusterhostSnapshotQuietPeriod()
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				reconcileSnapshotsOnTimer(ctx)
+			}
+		}
+	}()
+}
+
+func reconcileSnapshotsOnTimer(ctx context.Context) {
+	if !oldestSnapshotIsQuiet(time.Now()) {
+		return
+	}
+	snapshot, inventoryErr := inventory.Get(ctx)
+	if inventoryErr != nil {
+		logrus.WithFields(logrus.Fields{
+			"Error": inventoryErr.Error(),
+		}).Error("Unable to reconcile clusterhost snapshots")
+		return
+	}
+	clusterhostProcessing.Lock()
+	snapshotMutex.Lock()
+	flagged := reconcileQuietSnapshots(snapshot.Opaas, time.Now())
+	snapshotMutex.Unlock()
+	clusterhostProcessing.Unlock()
+	for _, report := range flagged {
+		reportMissingClusterhost(report.partition, report.offset, report.missing)
+	}
+	saveClusterhostSnapshotsIfChanged()
+}
+
+func oldestSnapshotIsQuiet(now time.Time) bool {
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+	if loadClusterhostSnapshots() != nil {
+		return false
+	}
+	oldestID := 0
+	for snapshotID := range snapshots.Open {
+		if oldestID == 0 || snapshotID < oldestID {
+			oldestID = snapshotID
+		}
+	}
+	if oldestID == 0 {
+		return false
+	}
+	return now.Sub(snapshots.Open[oldestID].LastRecord) >= utils.GetClusterhostSnapshotQuietPeriod()
+}
+
+// observeClusterhostInSnapshot marks a host as seen in its snapshot and
+// reconciles the snapshots that went quiet against the OPaaS inventory,
+// reporting hosts that reached the missing threshold.
+func observeClusterhostInSnapshot(partition int, offset int64, clusterhost ClusterHost, cluster *client.Cluster, opaasData *client.OpaasData) {
+	if clusterhost.SNAPSHOTID == 0 {
+		return
+	}
+	flagged, trackErr := trackClusterhostSnapshot(partition, offset, clusterhost.SNAPSHOTID, cluster.ID, clusterhost.HOSTNAME, opaasData, time.Now())
+	if trackErr != nil {
+		logrus.WithFields(logrus.Fields{
+			"clusterHost": clusterhost.HOSTNAME,
+			"snapshotId":  clusterhost.SNAPSHOTID,
+			"Error":       trackErr.Error(),
+		}).Error("Failed to track clusterhost snapshot")
+	}
+	for _, report := range flagged {
+		reportMissingClusterhost(report.partition, report.offset, report.missing)
+	}
+}
+
+func trackClusterhostSnapshot(partition int, offset int64, snapshotID int, clusterID string, hostName string, opaasData *client.OpaasData, now time.Time) ([]missingReport, error) {
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+	loadErr := loadClusterhostSnapshots()
+	if loadErr != nil {
+		return nil, loadErr
+	}
+	if snapshotID <= snapshots.Reconciled {
+		logrus.WithFields(logrus.Fields{
+			"clusterHost": hostName,
+			"snapshotId":  snapshotID,
+		}).Warn("Clusterhost record arrived after its snapshot was reconciled")
+		return nil, nil
+	}
+	snapshot, found := snapshots.Open[snapshotID]
+	if !found {
+		snapshot = &openSnapshot{Seen: make(map[string]map[string]bool)}
+		snapshots.Open[snapshotID] = snapshot
+	}
+	if snapshot.Seen[clusterID] == nil {
+		snapshot.Seen[clusterID] = make(map[string]bool)
+	}
+	snapshot.Seen[clusterID][hostName] = true
+	snapshot.LastRecord = now
+	snapshot.LastPartition = partition
+	snapshot.LastOffset = offset
+	snapshotsChanged = true
+	return reconcileQuietSnapshots(opaasData, now), nil
+}
+
+// reconcileQuietSnapshots must be called with snapshotMutex held. It
+// reconciles open snapshots oldest first and stops at the first one that is
+// still receiving records, so missed snapshots are always counted in order.
+func reconcileQuietSnapshots(opaasData *client.OpaasData, now time.Time) []missingReport {
+	snapshotIDs := make([]int, 0, len(snapshots.Open))
+	for snapshotID := range snapshots.Open {
+		snapshotIDs = append(snapshotIDs, snapshotID)
+	}
+	sort.Ints(snapshotIDs)
+	quietPeriod := utils.GetClusterhostSnapshotQuietPeriod()
+	flagged := []missingReport{}
+	for _, snapshotID := range snapshotIDs {
+		snapshot := snapshots.Open[snapshotID]
+		if now.Sub(snapshot.LastRecord) < quietPeriod {
+			break
+		}
+		for _, missing := range reconcileSnapshot(snapshotID, snapshot, opaasData, utils.GetMissingClusterhostSnapshots()) {
+			flagged = append(flagged, missingReport{
+				missing:   missing,
+				partition: snapshot.LastPartition,
+				offset:    snapshot.LastOffset,
+			})
+		}
+		delete(snapshots.Open, snapshotID)
+		snapshots.Reconciled = snapshotID
+		snapshotsChanged = true
+	}
+	return flagged
+}
+
+// reconcileSnapshot only judges clusterhosts whose cluster reported at least
+// one host in the completed snapshot, so a vCenter that was not collected
+// does not make all of its hosts look missing. Hosts OPaaS already lists as
+// decommissioned are not judged either.
+func reconcileSnapshot(snapshotID int, snapshot *openSnapshot, opaasData *client.OpaasData, threshold int) []MissingClusterhost {
+	flagged := []MissingClusterhost{}
+	inOpaas := make(map[string]bool)
+	for _, clusterhost := range opaasData.Clusterhosts {
+		if clusterhost.Status == client.ClusterhostDecommissioned {
+			continue
+		}
+		inOpaas[clusterhost.ID] = true
+		seenHosts, clusterReported := snapshot.Seen[clusterhost.ClusterID]
+		if !clusterReported {
+			continue
+		}
+		if seenHosts[clusterhost.Name] {
+			delete(snapshots.Missing, clusterhost.ID)
+			continue
+		}
+		missing, found := snapshots.Missing[clusterhost.ID]
+		if !found {
+			missing = &MissingClusterhost{
+				ClusterhostID:       clusterhost.ID,
+				HostName:            clusterhost.Name,
+				ServerID:            clusterhost.ServerID,
+				ClusterID:           clusterhost.ClusterID,
+				Status:              clusterhost.Status,
+				FirstMissedSnapshot: snapshotID,
+			}
+			snapshots.Missing[clusterhost.ID] = missing
+		}
+		missing.MissedSnapshots++
+		if missing.MissedSnapshots >= threshold && !missing.Reported {
+			missing.Reported = true
+			flagged = append(flagged, *missing)
+		}
+	}
+	for clusterhostID := range snapshots.Missing {
+		if !inOpaas[clusterhostID] {
+			delete(snapshots.Missing, clusterhostID)
+		}
+	}
+	logrus.WithFields(logrus.Fields{
+		"snapshotId":          snapshotID,
+		"missingClusterhosts": len(snapshots.Missing),
+		"newlyFlagged":        len(flagged),
+	}).Info("Reconciled clusterhost snapshot")
+	return flagged
+}
+
+// saveClusterhostSnapshotsIfChanged is called once per message rather than
+// once per record.
+func saveClusterhostSnapshotsIfChanged() {
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+	if !snapshotsChanged {
+		return
+	}
+	saveErr := saveClusterhostSnapshots()
+	if saveErr != nil {
+		logrus.WithFields(logrus.Fields{
+			"Error": saveErr.Error(),
+		}).Error("Failed to save clusterhost snapshots")
+		return
+	}
+	snapshotsChanged = false
+}
+
+// reportMissingClusterhost is given the partition and offset of the last
+// record of the snapshot the host went missing from.
+func reportMissingClusterhost(partition int, offset int64, missing MissingClusterhost) {
+	logFields := logrus.Fields{
+		"clusterHost":     missing.HostName,
+		"clusterhostId":   missing.ClusterhostID,
+		"clusterId":       missing.ClusterID,
+		"missedSnapshots": missing.MissedSnapshots,
+	}
+	logrus.WithFields(logFields).Warn("Clusterhost missing from vCenter")
+	decommissioned := false
+	if utils.GetDecommissionMissingClusterhosts() {
+		decommissioned = decommissionClusterhost(partition, offset, missing, logFields)
+	}
+	csvErr := utils.WriteToCSV(missing_clusterhost_file, []utils.CSVInfo{
+		utils.MissingClusterhostCSV{
+			Hostname:            missing.HostName,
+			ClusterhostId:       missing.ClusterhostID,
+			ServerId:            missing.ServerID,
+			ClusterId:           missing.ClusterID,
+			FirstMissedSnapshot: missing.FirstMissedSnapshot,
+			MissedSnapshots:     missing.MissedSnapshots,
+			Decommissioned:      decommissioned,
+		},
+	})
+	if csvErr != nil {
+		logrus.WithFields(logrus.Fields{
+			"clusterHost": missing.HostName,
+			"Error":       csvErr.Error(),
+		}).Error("Failed to write to csv file")
+	}
+	utils.SendMissingClusterHostSlackMessage(&utils.SlackCHParams{
+		Hostname:    missing.HostName,
+		ServerId:    missing.ServerID,
+		ClusterId:   missing.ClusterID,
+		MissedCount: missing.MissedSnapshots,
+	}, decommissioned)
+}
+
+func decommissionClusterhost(partition int, offset int64, missing MissingClusterhost, logFields logrus.Fields) bool {
+	patches := []client.Patch{
+		client.ReplacePatch("/status", client.ClusterhostDecommissioned),
+	}
+	if utils.IsDryRun() {
+		utils.RecordDryRunPatch(utils.DryRunPatch{
+			Timestamp:  time.Now(),
+			Partition:  partition,
+			Offset:     offset,
+			Model:      "clusterhost",
+			TargetID:   missing.ClusterhostID,
+			TargetName: missing.HostName,
+			Op:         client.PatchReplace,
+			Path:       "/status",
+			OldValue:   missing.Status,
+			NewValue:   client.ClusterhostDecommissioned,
+		})
+		return false
+	}
+	opaasAPI := client.NewOpaasApi()
+	patchErr := opaasAPI.PatchClusterhost(missing.ClusterhostID, patches)
+	observePatches(patches, patchErr)
+	if patchErr != nil {
+		logrus.WithFields(logFields).WithField("Error", patchErr.Error()).Error("Failed to decommission clusterhost")
+		return false
+	}
+	inventory.Invalidate(inventory.Clusterhosts)
+	logrus.WithFields(logFields).Info("Decommissioned clusterhost")
+	return true
+}
+
+func loadClusterhostSnapshots() error {
+	if snapshots != nil {
+		return nil
+	}
+	loaded := &clusterhostSnapshots{}
+	data, readErr := ioutil.ReadFile(clusterhost_snapshot_file)
+	if readErr != nil && !os.IsNotExist(readErr) {
+		return readErr
+	}
+	if readErr == nil {
+		unmarshalErr := json.Unmarshal(data, loaded)
+		if unmarshalErr != nil {
+			return unmarshalErr
+		}
+	}
+	if loaded.Open == nil {
+		loaded.Open = make(map[int]*openSnapshot)
+	}
+	if loaded.Missing == nil {
+		loaded.Missing = make(map[string]*MissingClusterhost)
+	}
+	snapshots = loaded
+	return nil
+}
+
+func saveClusterhostSnapshots() error {
+	data, marshalErr := json.Marshal(snapshots)
+	if marshalErr != nil {
+		return marshalErr
+	}
+	mkdirErr := os.MkdirAll(filepath.Dir(clusterhost_snapshot_file), 0755)
+	if mkdirErr != nil {
+		return mkdirErr
+	}
+	return utils.WriteFileAtomic(clusterhost_snapshot_file, data, 0644)
+}
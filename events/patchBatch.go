@@ -0,0 +1,118 @@
+package events
+
+import (
+	"fmt"
+
+	"github.com/opaas/capacity-worker/client"
+	"github.com/opaas/capacity-worker/inventory"
+	"github.com/opaas/capacity-worker/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// inventoryLists maps the models patches are sent for to the inventory list
+// that holds them.
+var inventoryLists = map[string]string{
+	"cluster":     inventory.Clusters,
+	"storage":     inventory.Storage,
+	"clusterhost": inventory.Clusterhosts,
+}
+
+// PatchError is returned by Process when some of a message's patches failed
+// for a reason other than a conflict. Err is the first failure a retry may
+// fix, or the first failure if none can.
+type PatchError struct {
+	Failed int
+	Total  int
+	Err    error
+}
+
+func (patchErr *PatchError) Error() string {
+	return fmt.Sprintf("%d of %d patches failed: %s", patchErr.Failed, patchErr.Total, patchErr.Err.Error())
+}
+
+func (patchErr *PatchError) Unwrap() error {
+	return patchErr.Err
+}
+
+// Temporary reports whether sending the message's patches again may succeed.
+func (patchErr *PatchError) Temporary() bool {
+	return client.IsTemporary(patchErr.Err)
+}
+
+// patchBatch collects the patches for one message and sends them together
+// through a client.PatchExecutor. It is flushed before Process returns, so a
+// message is only committed after its patches were sent.
+type patchBatch struct {
+	partition int
+	offset    int64
+	requests  []client.PatchRequest
+	models    []string
+	applies   []func()
+}
+
+func newPatchBatch(partition int, offset int64) *patchBatch {
+	return &patchBatch{
+		partition: partition,
+		offset:    offset,
+	}
+}
+
+// add queues a request. apply is called once the patch succeeded and writes
+// the new values back into the snapshot the patch was computed from, so later
+// messages in the same batch guard against what OPaaS now holds.
+func (batch *patchBatch) add(model string, request client.PatchRequest, apply func()) {
+	batch.requests = append(batch.requests, request)
+	batch.models = append(batch.models, model)
+	batch.applies = append(batch.applies, apply)
+}
+
+// send reports every result on its own, so one failing record does not hide
+// the others. Conflicts are not failures: the record changed and the next
+// snapshot patches it from its new value. Every other failure is returned as
+// a *PatchError.
+func (batch *patchBatch) send() error {
+	if len(batch.requests) == 0 {
+		return nil
+	}
+	executor := client.NewPatchExecutor(utils.GetPatchConcurrency())
+	results := executor.Execute(batch.requests)
+	failed := 0
+	var sendErr *PatchError
+	for i, result := range results {
+		observePatches(result.Request.Patches, result.Err)
+		logFields := logrus.Fields{
+			"offset": batch.offset,
+			"model":  batch.models[i],
+			"id":     result.Request.ID,
+		}
+		switch {
+		case result.Err == nil:
+			batch.applies[i]()
+			logrus.WithFields(logFields).Info("Successfully patched " + batch.models[i])
+		case client.IsConflict(result.Err):
+			inventory.Invalidate(inventoryLists[batch.models[i]])
+			failed++
+			logFields["Error"] = result.Err.Error()
+			logrus.WithFields(logFields).Warn("Record changed in OPaaS since it was read, patch not applied")
+		default:
+			failed++
+			logFields["Error"] = result.Err.Error()
+			logrus.WithFields(logFields).Error("Failed to patch " + batch.models[i])
+			if sendErr == nil {
+				sendErr = &PatchError{Total: len(results), Err: result.Err}
+			} else if !sendErr.Temporary() && client.IsTemporary(result.Err) {
+				sendErr.Err = result.Err
+			}
+			sendErr.Failed++
+		}
+	}
+	logrus.WithFields(logrus.Fields{
+		"offset":  batch.offset,
+		"patched": len(results) - failed,
+		"failed":  failed,
+	}).Info("Sent patches")
+	if sendErr != nil {
+		return sendErr
+	}
+	return nil
+}
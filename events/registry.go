@@ -0,0 +1,64 @@
+package events
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/opaas/capacity-worker/metrics"
+)
+
+var ErrUnknownStream = errors.New("No handler registered for streamName")
+
+// unknown_stream_label counts every stream without a handler, so a producer
+// cannot grow the stream label without bound.
+const unknown_stream_label string = "unknown"
+
+// Handler owns the streams it is registered for: it knows the record schema
+// of every supported schemaVersion and how to decode a validated envelope into
+// an Event that processes itself.
+type Handler struct {
+	Schemas map[int]RecordSchema
+	Decode  func(envelope *Envelope) (Event, error)
+}
+
+type RecordSchema struct {
+	RequiredFields []string
+	NewRecord      func() interface{}
+}
+
+var handlers = map[string]Handler{}
+
+// RegisterHandler is called from the init function of each handler file.
+func RegisterHandler(handler Handler, streamNames ...string) {
+	for _, streamName := range streamNames {
+		if _, exists := handlers[streamName]; exists {
+			panic(fmt.Sprintf("events: handler already registered for streamName %s", streamName))
+		}
+		handlers[streamName] = handler
+	}
+}
+
+// ConvertToEvent validates payload against the schema of its stream,
+// quarantines malformed records and decodes the rest with the stream's
+// handler. Streams without a handler return an error wrapping
+// ErrUnknownStream.
+func ConvertToEvent(offset int64, payload []byte) (Event, error) {
+	envelope, envelopeErr := DecodeEnvelope(payload)
+	if envelopeErr != nil {
+		return nil, envelopeErr
+	}
+	handler, found := handlers[envelope.StreamName]
+	if !found {
+		metrics.MessagesConsumed.WithLabelValues(unknown_stream_label).Inc()
+		return nil, fmt.Errorf("%w: %s", ErrUnknownStream, envelope.StreamName)
+	}
+	metrics.MessagesConsumed.WithLabelValues(envelope.StreamName).Inc()
+	rejections, validationErr := envelope.Validate(handler.Schemas)
+	if validationErr != nil {
+		return nil, validationErr
+	}
+	if len(rejections) != 0 {
+		QuarantineRecords(offset, envelope, rejections)
+	}
+	return handler.Decode(envelope)
+}
@@ -1,7 +1,9 @@
 package events
 
 import (
+	"github.com/opaas/capacity-worker/aliases"
 	"github.com/opaas/capacity-worker/client"
+	"github.com/opaas/capacity-worker/softlayer"
 	"github.com/opaas/capacity-worker/utils"
 	"github.com/sirupsen/logrus"
 )
@@ -27,17 +29,35 @@ type VMEvent struct {
 	VMs        []VM   `json:"data"`
 }
 
-func (event VMEvent) Process(offset int64, opaasData *client.OpaasData, SlData []utils.SoftLayerHosts) {
+func init() {
+	RegisterHandler(Handler{
+		Schemas: map[int]RecordSchema{
+			1: {
+				RequiredFields: []string{"VM_NAME", "SITE_ID"},
+				NewRecord:      func() interface{} { return &VM{} },
+			},
+		},
+		Decode: func(envelope *Envelope) (Event, error) {
+			event := &VMEvent{}
+			return event, envelope.Decode(event)
+		},
+	}, "xseries.vminfo")
+}
+
+func (event VMEvent) Process(partition int, offset int64, opaasData *client.OpaasData, SlData *softlayer.Data) error {
 	vmCSVs := []utils.CSVInfo{}
 	for _, vm := range event.VMs {
 		vmCSV := processVM(vm, opaasData)
 		vmCSVs = append(vmCSVs, vmCSV)
 	}
 	writeVMCSV(offset, vmCSVs)
+	return nil
 }
 
 func processVM(vm VM, opaasData *client.OpaasData) *utils.VMCSV {
-	vm.SITEID = mapSites(vm.SITEID)
+	vm.SITEID = mapSites(vm.SITEID, opaasData)
+	vm.DATACENTER = aliases.Datacenter(vm.DATACENTER)
+	vm.PODID = aliases.Pod(vm.PODID)
 	vmCSV := createVMCSV(vm)
 	opaasInstance := findMatchingVM(vm, opaasData)
 	if opaasInstance != nil {
@@ -51,11 +71,9 @@ func findMatchingVM(vm VM, opaasData *client.OpaasData) *client.Instance {
 		"hostname": vm.VMName,
 	}
 	logrus.WithFields(logFields).Info("Searching for matching vm")
-	for _, opaasInstance := range opaasData.Instances {
-		if vm.VMName == opaasInstance.Hostname {
-			logrus.WithFields(logFields).Info("Found matching vm")
-			return &opaasInstance
-		}
+	if opaasInstance := opaasData.InstanceByHostname(vm.VMName); opaasInstance != nil {
+		logrus.WithFields(logFields).Info("Found matching vm")
+		return opaasInstance
 	}
 	logrus.WithFields(logFields).Info("Failed to find matching vm")
 	return nil
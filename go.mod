@@ -3,9 +3,13 @@ module github.com/opaas/capacity-worker
 go 1.13
 
 require (
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/joho/godotenv v1.3.0
+	github.com/prometheus/client_golang v1.7.0
 	github.com/segmentio/kafka-go v0.3.7
 	github.com/sirupsen/logrus v1.6.0
 	github.com/slack-go/slack v0.6.5
+	github.com/spf13/cast v1.3.0
 	github.com/spf13/viper v1.7.0
+	gopkg.in/yaml.v2 v2.2.5
 )
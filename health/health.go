@@ -0,0 +1,103 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type Check func() error
+
+type report struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+var (
+	mutex    sync.Mutex
+	lastBeat = time.Now()
+	checks   = map[string]Check{}
+	statuses = map[string]error{}
+)
+
+// Beat records that the worker's main loop is still turning.
+func Beat() {
+	mutex.Lock()
+	lastBeat = time.Now()
+	mutex.Unlock()
+}
+
+// RegisterReadinessCheck adds a check that is run on every readiness probe.
+func RegisterReadinessCheck(name string, check Check) {
+	mutex.Lock()
+	checks[name] = check
+	mutex.Unlock()
+}
+
+// SetStatus records the outcome of the last attempt at something readiness
+// depends on, such as fetching the OPaaS snapshot.
+func SetStatus(name string, err error) {
+	mutex.Lock()
+	statuses[name] = err
+	mutex.Unlock()
+}
+
+func LivenessHandler(timeout time.Duration) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		mutex.Lock()
+		sinceLastBeat := time.Since(lastBeat)
+		mutex.Unlock()
+		if sinceLastBeat > timeout {
+			writeReport(writer, http.StatusServiceUnavailable, report{
+				Status: "unavailable",
+				Checks: map[string]string{"mainLoop": "no progress for " + sinceLastBeat.Round(time.Second).String()},
+			})
+			return
+		}
+		writeReport(writer, http.StatusOK, report{Status: "ok"})
+	}
+}
+
+func ReadinessHandler() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		results := map[string]error{}
+		mutex.Lock()
+		for name, err := range statuses {
+			results[name] = err
+		}
+		readinessChecks := map[string]Check{}
+		for name, check := range checks {
+			readinessChecks[name] = check
+		}
+		mutex.Unlock()
+		for name, check := range readinessChecks {
+			results[name] = check()
+		}
+		writeReadinessReport(writer, results)
+	}
+}
+
+func writeReadinessReport(writer http.ResponseWriter, results map[string]error) {
+	readiness := report{
+		Status: "ok",
+		Checks: map[string]string{},
+	}
+	statusCode := http.StatusOK
+	for name, err := range results {
+		if err != nil {
+			readiness.Checks[name] = err.Error()
+			readiness.Status = "unavailable"
+			statusCode = http.StatusServiceUnavailable
+			continue
+		}
+		readiness.Checks[name] = "ok"
+	}
+	writeReport(writer, statusCode, readiness)
+}
+
+func writeReport(writer http.ResponseWriter, statusCode int, healthReport report) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(statusCode)
+	json.NewEncoder(writer).Encode(healthReport)
+}
@@ -0,0 +1,255 @@
+package inventory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/opaas/capacity-worker/client"
+	"github.com/opaas/capacity-worker/health"
+	"github.com/opaas/capacity-worker/softlayer"
+	"github.com/sirupsen/logrus"
+)
+
+// The OPaaS lists a snapshot holds. Invalidate takes these.
+const (
+	Instances    string = "instances"
+	Storage      string = "storage"
+	Clusters     string = "clusters"
+	Clusterhosts string = "clusterhosts"
+)
+
+const health_status_name string = "opaasSnapshot"
+
+var opaasLists = []string{Instances, Storage, Clusters, Clusterhosts}
+
+var errNotFetched = errors.New("OPaaS inventory has not been fetched yet")
+
+// Snapshot is one download of the OPaaS and SoftLayer inventories.
+type Snapshot struct {
+	Opaas              *client.OpaasData
+	SoftLayer          *softlayer.Data
+	FetchedAt          time.Time
+	SoftLayerFetchedAt time.Time
+
+	generations map[string]int
+}
+
+var (
+	cacheMutex   sync.Mutex
+	current      *Snapshot
+	generations  = make(map[string]int)
+	ttl          time.Duration
+	softLayerTTL time.Duration
+
+	// fetchMutex lets only one download run at a time, so a batch and the
+	// background refresh never fetch the same snapshot twice.
+	fetchMutex      sync.Mutex
+	conditionalAPI  *client.OpaasApi
+	softLayerClient *softlayer.Client
+)
+
+// Start sets how long a snapshot may be served, and the SoftLayer hardware
+// within it, fetches the first snapshot and refreshes it in the background
+// until ctx is done. A TTL of zero disables the cache, and every call to Get
+// downloads a new snapshot. Readiness fails until a snapshot was fetched.
+func Start(ctx context.Context, cacheTTL time.Duration, hardwareTTL time.Duration) {
+	health.SetStatus(health_status_name, errNotFetched)
+	cacheMutex.Lock()
+	ttl = cacheTTL
+	softLayerTTL = hardwareTTL
+	cacheMutex.Unlock()
+	go refreshPeriodically(ctx, cacheTTL)
+}
+
+// Get returns the cached snapshot. If it expired every OPaaS list is
+// downloaded again; if only some lists were invalidated, only those are.
+// A download is abandoned when ctx is done.
+func Get(ctx context.Context) (*Snapshot, error) {
+	if snapshot := fresh(); snapshot != nil {
+		return snapshot, nil
+	}
+	fetchMutex.Lock()
+	defer fetchMutex.Unlock()
+	if snapshot := fresh(); snapshot != nil {
+		return snapshot, nil
+	}
+	return refresh(ctx, false)
+}
+
+// Invalidate makes the next Get download the given lists again. It is called
+// when the worker changed OPaaS in a way it could not write back into the
+// snapshot itself, e.g. after a create or a conflicting patch, so its own
+// changes are not undone from stale data.
+func Invalidate(lists ...string) {
+	cacheMutex.Lock()
+	for _, list := range lists {
+		generations[list]++
+	}
+	cacheMutex.Unlock()
+}
+
+func fresh() *Snapshot {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	if current == nil || time.Since(current.FetchedAt) >= ttl || len(staleLists(current)) != 0 {
+		return nil
+	}
+	return current
+}
+
+// staleLists must be called with cacheMutex held.
+func staleLists(snapshot *Snapshot) []string {
+	stale := []string{}
+	for _, list := range opaasLists {
+		if snapshot.generations[list] != generations[list] {
+			stale = append(stale, list)
+		}
+	}
+	return stale
+}
+
+// refreshPeriodically refreshes every half TTL, and only once when the cache
+// is disabled.
+func refreshPeriodically(ctx context.Context, cacheTTL time.Duration) {
+	refreshInBackground(ctx)
+	if cacheTTL <= 0 {
+		return
+	}
+	ticker := time.NewTicker(cacheTTL / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			refreshInBackground(ctx)
+		}
+	}
+}
+
+func refreshInBackground(ctx context.Context) {
+	fetchMutex.Lock()
+	_, refreshErr := refresh(ctx, true)
+	fetchMutex.Unlock()
+	if refreshErr != nil {
+		logrus.WithFields(logrus.Fields{
+			"Error": refreshErr.Error(),
+		}).Error("Failed to refresh inventory in the background")
+	}
+}
+
+// refresh must be called with fetchMutex held. It downloads every OPaaS list
+// when all is set or the snapshot expired, and otherwise only the invalidated
+// ones. Lists are stamped with their generation from before the download, so
+// an Invalidate that races with it still forces another one. The outcome is
+// the readiness status of the inventory.
+func refresh(ctx context.Context, all bool) (*Snapshot, error) {
+	cacheMutex.Lock()
+	previous := current
+	fetchGenerations := make(map[string]int, len(generations))
+	for list, listGeneration := range generations {
+		fetchGenerations[list] = listGeneration
+	}
+	lists := opaasLists
+	if !all && previous != nil && time.Since(previous.FetchedAt) < ttl {
+		lists = staleLists(previous)
+	}
+	cacheMutex.Unlock()
+	if conditionalAPI == nil {
+		conditionalAPI = client.NewConditionalOpaasApi()
+	}
+	opaasData, opaasErr := getOpaasData(conditionalAPI.WithContext(ctx), previous, lists)
+	health.SetStatus(health_status_name, opaasErr)
+	if opaasErr != nil {
+		return nil, opaasErr
+	}
+	snapshot := &Snapshot{
+		Opaas:       opaasData,
+		FetchedAt:   time.Now(),
+		generations: fetchGenerations,
+	}
+	if len(lists) != len(opaasLists) {
+		snapshot.FetchedAt = previous.FetchedAt
+	}
+	snapshot.SoftLayer, snapshot.SoftLayerFetchedAt = getSoftLayerData(ctx, previous)
+	cacheMutex.Lock()
+	current = snapshot
+	cacheMutex.Unlock()
+	hardwareCount := 0
+	if snapshot.SoftLayer != nil {
+		hardwareCount = len(snapshot.SoftLayer.Hardware)
+	}
+	logrus.WithFields(logrus.Fields{
+		"refreshed":    lists,
+		"instances":    len(opaasData.Instances),
+		"storage":      len(opaasData.Storage),
+		"clusters":     len(opaasData.Clusters),
+		"clusterhosts": len(opaasData.Clusterhosts),
+		"hardware":     hardwareCount,
+	}).Info("Refreshed inventory")
+	return snapshot, nil
+}
+
+// getSoftLayerData reuses the previous snapshot's hardware for
+// CAP_SOFTLAYER_TTL, since SoftLayer has no conditional requests. It falls
+// back to the previous hardware when SoftLayer cannot be read, and to nil
+// when there is none. Without it clusterhosts are matched but their server
+// IDs are not checked.
+func getSoftLayerData(ctx context.Context, previous *Snapshot) (*softlayer.Data, time.Time) {
+	if previous != nil && previous.SoftLayer != nil && time.Since(previous.SoftLayerFetchedAt) < softLayerTTL {
+		return previous.SoftLayer, previous.SoftLayerFetchedAt
+	}
+	if softLayerClient == nil {
+		slClient, clientErr := softlayer.NewClient()
+		if clientErr != nil {
+			logrus.WithFields(logrus.Fields{
+				"Error": clientErr.Error(),
+			}).Warn("Skipping SoftLayer inventory")
+			return nil, time.Time{}
+		}
+		softLayerClient = slClient
+	}
+	hardware, hardwareErr := softLayerClient.GetHardware(ctx)
+	if hardwareErr != nil {
+		logrus.WithFields(logrus.Fields{
+			"Error":        hardwareErr.Error(),
+			"unauthorized": softlayer.IsUnauthorized(hardwareErr),
+		}).Error("Unable to retrieve SoftLayer hardware")
+		if previous == nil {
+			return nil, time.Time{}
+		}
+		return previous.SoftLayer, previous.SoftLayerFetchedAt
+	}
+	return softlayer.NewData(hardware), time.Now()
+}
+
+// getOpaasData downloads the given lists and takes the others from previous.
+func getOpaasData(opaasAPI *client.OpaasApi, previous *Snapshot, lists []string) (*client.OpaasData, error) {
+	opaasData := &client.OpaasData{}
+	if previous != nil {
+		opaasData.Instances = previous.Opaas.Instances
+		opaasData.Storage = previous.Opaas.Storage
+		opaasData.Clusters = previous.Opaas.Clusters
+		opaasData.Clusterhosts = previous.Opaas.Clusterhosts
+	}
+	for _, list := range lists {
+		var listErr error
+		switch list {
+		case Instances:
+			opaasData.Instances, listErr = opaasAPI.GetInstances()
+		case Storage:
+			opaasData.Storage, listErr = opaasAPI.GetStorage()
+		case Clusters:
+			opaasData.Clusters, listErr = opaasAPI.GetClusters()
+		case Clusterhosts:
+			opaasData.Clusterhosts, listErr = opaasAPI.GetClusterhosts()
+		}
+		if listErr != nil {
+			return nil, fmt.Errorf("Unable to retrieve %s: %w", list, listErr)
+		}
+	}
+	return client.NewOpaasData(opaasData.Instances, opaasData.Storage, opaasData.Clusters, opaasData.Clusterhosts), nil
+}
@@ -0,0 +1,299 @@
+package kafka
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/opaas/capacity-worker/health"
+	"github.com/opaas/capacity-worker/metrics"
+	"github.com/opaas/capacity-worker/utils"
+	kafkaGo "github.com/segmentio/kafka-go"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	reconnect_backoff_min    time.Duration = 1 * time.Second
+	reconnect_backoff_max    time.Duration = 1 * time.Minute
+	partition_check_interval time.Duration = 5 * time.Minute
+)
+
+type BatchHandler func(messageBatch []kafkaGo.Message) error
+
+// Committer marks messages as processed. Flush is called once the batch
+// handler is done with a batch, and saves what Commit only recorded.
+type Committer interface {
+	Commit(message kafkaGo.Message) error
+	Flush() error
+}
+
+type fetchResult struct {
+	message kafkaGo.Message
+	err     error
+}
+
+// Consumer keeps its readers open for the life of the worker and hands
+// batches of at most batchSize messages, or whatever arrived within
+// batchWindow, to a BatchHandler. Without a consumer group it runs one reader
+// per topic partition and tracks their offsets in an OffsetStore.
+type Consumer struct {
+	config              *utils.KafkaConfig
+	offsetStore         utils.OffsetStore
+	batchSize           int
+	batchWindow         time.Duration
+	readers             []*kafkaGo.Reader
+	partitions          []int
+	partitionsCheckedAt time.Time
+	fetched             chan fetchResult
+	stopFetching        context.CancelFunc
+	fetchers            sync.WaitGroup
+	reconnectAttempt    int
+}
+
+func NewConsumer() *Consumer {
+	batchConfig := utils.GetBatchConfig()
+	return &Consumer{
+		config:      utils.GetKafkaConfig(),
+		offsetStore: utils.NewOffsetStore(),
+		batchSize:   batchConfig.Size,
+		batchWindow: batchConfig.Window,
+	}
+}
+
+// Run fetches and handles batches until ctx is cancelled or handleBatch fails.
+// A batch that is still being fetched when ctx is cancelled is dropped without
+// being committed, so it is read again on the next start.
+func (consumer *Consumer) Run(ctx context.Context, handleBatch BatchHandler) error {
+	openErr := consumer.open()
+	if openErr != nil {
+		consumer.reconnect(ctx, openErr)
+	}
+	for ctx.Err() == nil {
+		health.Beat()
+		messageBatch, fetchErr := consumer.fetchBatch(ctx)
+		consumer.observeLag()
+		if ctx.Err() != nil {
+			logrus.WithFields(logrus.Fields{
+				"messageBatchLength": len(messageBatch),
+			}).Info("Stopped fetching messages from kafka")
+			return nil
+		}
+		if len(messageBatch) != 0 {
+			handleErr := handleBatch(messageBatch)
+			if handleErr != nil {
+				return handleErr
+			}
+		} else if fetchErr == nil {
+			logrus.Info("No new messages read from kafka")
+		}
+		if fetchErr == nil {
+			fetchErr = consumer.refreshPartitions()
+		}
+		if fetchErr != nil {
+			consumer.reconnect(ctx, fetchErr)
+			continue
+		}
+		consumer.reconnectAttempt = 0
+	}
+	return nil
+}
+
+func (consumer *Consumer) fetchBatch(ctx context.Context) ([]kafkaGo.Message, error) {
+	windowTimer := time.NewTimer(consumer.batchWindow)
+	defer windowTimer.Stop()
+	var messageBatch []kafkaGo.Message
+	for len(messageBatch) < consumer.batchSize {
+		select {
+		case result := <-consumer.fetched:
+			if result.err != nil {
+				return messageBatch, result.err
+			}
+			messageBatch = append(messageBatch, result.message)
+		case <-windowTimer.C:
+			return messageBatch, nil
+		case <-ctx.Done():
+			return messageBatch, ctx.Err()
+		}
+	}
+	return messageBatch, nil
+}
+
+func (consumer *Consumer) observeLag() {
+	for _, reader := range consumer.readers {
+		if consumer.usesConsumerGroup() {
+			metrics.ConsumerLag.WithLabelValues(consumer.config.Topic, "assigned").Set(float64(reader.Stats().Lag))
+			continue
+		}
+		partition := strconv.Itoa(reader.Config().Partition)
+		metrics.ConsumerLag.WithLabelValues(consumer.config.Topic, partition).Set(float64(reader.Lag()))
+	}
+}
+
+func (consumer *Consumer) open() error {
+	readers, openErr := consumer.openReaders()
+	if openErr != nil {
+		return openErr
+	}
+	fetchContext, stopFetching := context.WithCancel(context.Background())
+	fetched := make(chan fetchResult)
+	for _, reader := range readers {
+		consumer.fetchers.Add(1)
+		go consumer.fetchMessages(fetchContext, reader, fetched)
+	}
+	consumer.readers = readers
+	consumer.fetched = fetched
+	consumer.stopFetching = stopFetching
+	return nil
+}
+
+// openReaders reads the Kafka settings again, so a rotated password is used
+// whenever the readers are recreated.
+func (consumer *Consumer) openReaders() ([]*kafkaGo.Reader, error) {
+	kafkaConfig := utils.GetKafkaConfig()
+	if consumer.usesConsumerGroup() {
+		return []*kafkaGo.Reader{newKafkaGroupReader(kafkaConfig)}, nil
+	}
+	partitions, lookupErr := lookupPartitions(kafkaConfig)
+	if lookupErr != nil {
+		return nil, lookupErr
+	}
+	offsets, offsetErr := consumer.offsetStore.ReadOffsets(kafkaConfig.Topic)
+	if offsetErr != nil {
+		return nil, offsetErr
+	}
+	readers := []*kafkaGo.Reader{}
+	for _, partition := range partitions {
+		offset := nextOffset(offsets, partition)
+		logrus.WithFields(logrus.Fields{
+			"topic":     kafkaConfig.Topic,
+			"partition": partition,
+			"offset":    offset,
+		}).Info("Opening kafka partition reader")
+		readers = append(readers, newKafkaPartitionReader(kafkaConfig, partition, offset))
+	}
+	consumer.partitions = partitions
+	consumer.partitionsCheckedAt = time.Now()
+	return readers, nil
+}
+
+func (consumer *Consumer) fetchMessages(fetchContext context.Context, reader *kafkaGo.Reader, fetched chan<- fetchResult) {
+	defer consumer.fetchers.Done()
+	for {
+		message, fetchErr := reader.FetchMessage(fetchContext)
+		if fetchContext.Err() != nil {
+			return
+		}
+		select {
+		case fetched <- fetchResult{message: message, err: fetchErr}:
+		case <-fetchContext.Done():
+			return
+		}
+		if fetchErr != nil {
+			return
+		}
+	}
+}
+
+func (consumer *Consumer) refreshPartitions() error {
+	if consumer.usesConsumerGroup() || time.Since(consumer.partitionsCheckedAt) < partition_check_interval {
+		return nil
+	}
+	partitions, lookupErr := lookupPartitions(utils.GetKafkaConfig())
+	if lookupErr != nil {
+		return lookupErr
+	}
+	consumer.partitionsCheckedAt = time.Now()
+	if samePartitions(consumer.partitions, partitions) {
+		return nil
+	}
+	logrus.WithFields(logrus.Fields{
+		"topic":         consumer.config.Topic,
+		"oldPartitions": consumer.partitions,
+		"newPartitions": partitions,
+	}).Info("Topic partitions changed, reopening kafka readers")
+	consumer.close()
+	return consumer.open()
+}
+
+func samePartitions(oldPartitions []int, newPartitions []int) bool {
+	if len(oldPartitions) != len(newPartitions) {
+		return false
+	}
+	for i := range oldPartitions {
+		if oldPartitions[i] != newPartitions[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (consumer *Consumer) reconnect(ctx context.Context, cause error) {
+	for cause != nil && ctx.Err() == nil {
+		health.Beat()
+		consumer.reconnectAttempt++
+		backoff := utils.ExponentialBackoff(consumer.reconnectAttempt, reconnect_backoff_min, reconnect_backoff_max)
+		logrus.WithFields(logrus.Fields{
+			"Error":   cause.Error(),
+			"attempt": consumer.reconnectAttempt,
+			"backoff": backoff.String(),
+		}).Error("Kafka reader failed, reconnecting")
+		consumer.close()
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		cause = consumer.open()
+	}
+}
+
+// CheckBrokers reports whether at least one of the configured brokers
+// accepts a connection.
+func (consumer *Consumer) CheckBrokers() error {
+	return checkBrokers(utils.GetKafkaConfig())
+}
+
+func (consumer *Consumer) CheckOffsetStore() error {
+	if consumer.usesConsumerGroup() {
+		return nil
+	}
+	return consumer.offsetStore.CheckWritable()
+}
+
+func (consumer *Consumer) usesConsumerGroup() bool {
+	return consumer.config.GroupID != ""
+}
+
+// Commit records that message has been processed, either by committing it to
+// the consumer group or by setting its partition's offset in the offset store
+// until the next Flush.
+func (consumer *Consumer) Commit(message kafkaGo.Message) error {
+	if consumer.usesConsumerGroup() {
+		return consumer.readers[0].CommitMessages(context.Background(), message)
+	}
+	return consumer.offsetStore.SetOffset(message.Topic, message.Partition, message.Offset)
+}
+
+func (consumer *Consumer) Flush() error {
+	if consumer.usesConsumerGroup() {
+		return nil
+	}
+	return consumer.offsetStore.Flush()
+}
+
+func (consumer *Consumer) close() {
+	if consumer.stopFetching != nil {
+		consumer.stopFetching()
+	}
+	consumer.fetchers.Wait()
+	for _, reader := range consumer.readers {
+		CloseKafkaReader(reader)
+	}
+	consumer.readers = nil
+	consumer.fetched = nil
+}
+
+func (consumer *Consumer) Close() {
+	consumer.close()
+}
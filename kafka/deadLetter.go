@@ -0,0 +1,256 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/opaas/capacity-worker/utils"
+	kafkaGo "github.com/segmentio/kafka-go"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DeadLetterReasonHeader          string = "dlq-reason"
+	DeadLetterSourceTopicHeader     string = "dlq-source-topic"
+	DeadLetterSourcePartitionHeader string = "dlq-source-partition"
+	DeadLetterSourceOffsetHeader    string = "dlq-source-offset"
+	DeadLetterHostnameHeader        string = "dlq-worker-hostname"
+
+	dead_letter_write_timeout time.Duration = 10 * time.Second
+	dead_letter_tail_gap      int64         = 16
+)
+
+var errReplayTailReached = errors.New("No dead letters left before the last offset")
+
+// DeadLetterWriter publishes messages the worker could not handle to
+// CAP_KAFKA_DLQ_TOPIC. When no dead-letter topic is configured Publish fails,
+// so the message is retried instead of being committed and lost.
+type DeadLetterWriter struct {
+	writer   *kafkaGo.Writer
+	hostname string
+}
+
+func NewDeadLetterWriter() *DeadLetterWriter {
+	kafkaConfig := utils.GetKafkaConfig()
+	hostname, _ := os.Hostname()
+	deadLetterWriter := &DeadLetterWriter{
+		hostname: hostname,
+	}
+	if kafkaConfig.DLQTopic != "" {
+		deadLetterWriter.writer = kafkaGo.NewWriter(kafkaGo.WriterConfig{
+			Brokers:   kafkaConfig.Brokers,
+			Topic:     kafkaConfig.DLQTopic,
+			Dialer:    createKafkaDialer(kafkaConfig),
+			BatchSize: 1,
+		})
+	}
+	return deadLetterWriter
+}
+
+func (deadLetterWriter *DeadLetterWriter) Publish(message kafkaGo.Message, reason error) error {
+	logFields := logrus.Fields{
+		"topic":     message.Topic,
+		"partition": message.Partition,
+		"offset":    message.Offset,
+		"reason":    reason.Error(),
+	}
+	if deadLetterWriter.writer == nil {
+		return errors.New("CAP_KAFKA_DLQ_TOPIC env variable is not set")
+	}
+	deadLetter := kafkaGo.Message{
+		Key:     message.Key,
+		Value:   message.Value,
+		Headers: deadLetterWriter.createHeaders(message, reason),
+	}
+	contextWithTimeout, cancelTimeout := context.WithTimeout(context.Background(), dead_letter_write_timeout)
+	defer cancelTimeout()
+	writeErr := deadLetterWriter.writer.WriteMessages(contextWithTimeout, deadLetter)
+	if writeErr != nil {
+		return writeErr
+	}
+	logrus.WithFields(logFields).Info("Published message to dead-letter topic")
+	return nil
+}
+
+// createHeaders keeps the source position of messages that are being replayed
+// from the dead-letter topic so a second failure still points at the original
+// record.
+func (deadLetterWriter *DeadLetterWriter) createHeaders(message kafkaGo.Message, reason error) []kafkaGo.Header {
+	headers := []kafkaGo.Header{}
+	for _, header := range message.Headers {
+		if header.Key != DeadLetterReasonHeader && header.Key != DeadLetterHostnameHeader {
+			headers = append(headers, header)
+		}
+	}
+	if findHeader(message.Headers, DeadLetterSourceTopicHeader) == "" {
+		headers = append(headers,
+			kafkaGo.Header{Key: DeadLetterSourceTopicHeader, Value: []byte(message.Topic)},
+			kafkaGo.Header{Key: DeadLetterSourcePartitionHeader, Value: []byte(strconv.Itoa(message.Partition))},
+			kafkaGo.Header{Key: DeadLetterSourceOffsetHeader, Value: []byte(strconv.FormatInt(message.Offset, 10))},
+		)
+	}
+	return append(headers,
+		kafkaGo.Header{Key: DeadLetterReasonHeader, Value: []byte(reason.Error())},
+		kafkaGo.Header{Key: DeadLetterHostnameHeader, Value: []byte(deadLetterWriter.hostname)},
+	)
+}
+
+func findHeader(headers []kafkaGo.Header, key string) string {
+	for _, header := range headers {
+		if header.Key == key {
+			return string(header.Value)
+		}
+	}
+	return ""
+}
+
+func (deadLetterWriter *DeadLetterWriter) Close() {
+	if deadLetterWriter.writer == nil {
+		return
+	}
+	writerCloseErr := deadLetterWriter.writer.Close()
+	if writerCloseErr != nil {
+		logrus.WithFields(logrus.Fields{
+			"Error": writerCloseErr.Error(),
+		}).Info("Error closing dead-letter writer")
+	}
+}
+
+// DeadLetterReplayer reads every partition of the dead-letter topic up to the
+// last offset present when the replay started, recording its progress in
+// DEAD_LETTER_OFFSET_FILE so messages are only replayed once.
+type DeadLetterReplayer struct {
+	config      *utils.KafkaConfig
+	offsetStore utils.OffsetStore
+	batchSize   int
+	batchWindow time.Duration
+}
+
+func NewDeadLetterReplayer() (*DeadLetterReplayer, error) {
+	kafkaConfig := utils.GetKafkaConfig()
+	if kafkaConfig.DLQTopic == "" {
+		return nil, errors.New("CAP_KAFKA_DLQ_TOPIC env variable is not set")
+	}
+	kafkaConfig.Topic = kafkaConfig.DLQTopic
+	batchConfig := utils.GetBatchConfig()
+	return &DeadLetterReplayer{
+		config:      kafkaConfig,
+		offsetStore: utils.NewFileOffsetStore(utils.DEAD_LETTER_OFFSET_FILE),
+		batchSize:   batchConfig.Size,
+		batchWindow: batchConfig.Window,
+	}, nil
+}
+
+func (replayer *DeadLetterReplayer) Run(ctx context.Context, handleBatch BatchHandler) error {
+	partitions, lookupErr := lookupPartitions(replayer.config)
+	if lookupErr != nil {
+		return lookupErr
+	}
+	offsets, offsetErr := replayer.offsetStore.ReadOffsets(replayer.config.Topic)
+	if offsetErr != nil {
+		return offsetErr
+	}
+	for _, partition := range partitions {
+		replayErr := replayer.replayPartition(ctx, partition, nextOffset(offsets, partition), handleBatch)
+		if replayErr != nil {
+			return replayErr
+		}
+	}
+	return nil
+}
+
+func (replayer *DeadLetterReplayer) replayPartition(ctx context.Context, partition int, startOffset int64, handleBatch BatchHandler) error {
+	firstOffset, lastOffset, offsetsErr := readPartitionOffsets(replayer.config, partition)
+	if offsetsErr != nil {
+		return offsetsErr
+	}
+	if startOffset == kafkaGo.FirstOffset || startOffset < firstOffset {
+		startOffset = firstOffset
+	}
+	logFields := logrus.Fields{
+		"topic":       replayer.config.Topic,
+		"partition":   partition,
+		"startOffset": startOffset,
+		"lastOffset":  lastOffset,
+	}
+	if startOffset >= lastOffset {
+		logrus.WithFields(logFields).Info("No dead letters to replay for partition")
+		return nil
+	}
+	logrus.WithFields(logFields).Info("Replaying dead letters for partition")
+	reader := newKafkaPartitionReader(replayer.config, partition, startOffset)
+	defer CloseKafkaReader(reader)
+	var messageBatch []kafkaGo.Message
+	for offset := startOffset; offset < lastOffset; {
+		message, fetchErr := replayer.fetchBeforeLastOffset(ctx, reader, lastOffset-offset)
+		if errors.Is(fetchErr, errReplayTailReached) {
+			logrus.WithFields(logFields).WithField("offset", offset).Info("No more dead letters before the last offset")
+			break
+		}
+		if fetchErr != nil {
+			return fetchErr
+		}
+		// Dead letters published since the replay started are left for the
+		// next one.
+		if message.Offset >= lastOffset {
+			break
+		}
+		offset = message.Offset + 1
+		messageBatch = append(messageBatch, message)
+		if len(messageBatch) == replayer.batchSize {
+			handleErr := handleBatch(messageBatch)
+			if handleErr != nil {
+				return handleErr
+			}
+			messageBatch = nil
+		}
+	}
+	if len(messageBatch) > 0 {
+		return handleBatch(messageBatch)
+	}
+	return nil
+}
+
+// fetchBeforeLastOffset waits for the next dead letter until ctx is done. The
+// offsets just below the last one may hold no message at all, e.g. transaction
+// markers, so once fewer than dead_letter_tail_gap offsets remain a fetch that
+// sees nothing for a batch window ends the replay of the partition instead.
+func (replayer *DeadLetterReplayer) fetchBeforeLastOffset(ctx context.Context, reader *kafkaGo.Reader, remaining int64) (kafkaGo.Message, error) {
+	if remaining > dead_letter_tail_gap {
+		return reader.FetchMessage(ctx)
+	}
+	contextWithTimeout, cancelTimeout := context.WithTimeout(ctx, replayer.batchWindow)
+	defer cancelTimeout()
+	message, fetchErr := reader.FetchMessage(contextWithTimeout)
+	if fetchErr != nil && ctx.Err() == nil && errors.Is(fetchErr, context.DeadlineExceeded) {
+		return message, errReplayTailReached
+	}
+	return message, fetchErr
+}
+
+func readPartitionOffsets(kafkaConfig *utils.KafkaConfig, partition int) (int64, int64, error) {
+	kafkaDialer := createKafkaDialer(kafkaConfig)
+	contextWithTimeout, cancelTimeout := context.WithTimeout(context.Background(), partition_lookup_timeout)
+	defer cancelTimeout()
+	dialErr := errors.New("No kafka brokers configured")
+	for _, broker := range kafkaConfig.Brokers {
+		var conn *kafkaGo.Conn
+		conn, dialErr = kafkaDialer.DialLeader(contextWithTimeout, "tcp", broker, kafkaConfig.Topic, partition)
+		if dialErr == nil {
+			defer conn.Close()
+			return conn.ReadOffsets()
+		}
+	}
+	return 0, 0, dialErr
+}
+
+func (replayer *DeadLetterReplayer) Commit(message kafkaGo.Message) error {
+	return replayer.offsetStore.SetOffset(message.Topic, message.Partition, message.Offset)
+}
+
+func (replayer *DeadLetterReplayer) Flush() error {
+	return replayer.offsetStore.Flush()
+}
@@ -1,29 +1,40 @@
 package kafka
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"github.com/opaas/capacity-worker/utils"
+	"sort"
 	"time"
 
 	kafkaGo "github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
 	"github.com/segmentio/kafka-go/sasl/plain"
 	"github.com/sirupsen/logrus"
 )
 
-type KafkaEvent struct {
-	StreamName string `json:"streamName"`
+const (
+	partition_lookup_timeout time.Duration = 10 * time.Second
+	broker_check_timeout     time.Duration = 3 * time.Second
+)
+
+func newKafkaGroupReader(kafkaConfig *utils.KafkaConfig) *kafkaGo.Reader {
+	kafkaReaderConfig := createKafkaReaderConfig(kafkaConfig)
+	kafkaReaderConfig.GroupID = kafkaConfig.GroupID
+	kafkaReaderConfig.WatchPartitionChanges = true
+	return kafkaGo.NewReader(kafkaReaderConfig)
 }
 
-func NewKafkaReader() *kafkaGo.Reader {
-	kafkaReaderConfig := createKafkaReaderConfig()
+func newKafkaPartitionReader(kafkaConfig *utils.KafkaConfig, partition int, offset int64) *kafkaGo.Reader {
+	kafkaReaderConfig := createKafkaReaderConfig(kafkaConfig)
+	kafkaReaderConfig.Partition = partition
 	kafkaReader := kafkaGo.NewReader(kafkaReaderConfig)
-	currentOffset := getCurrentOffset()
-	kafkaReader.SetOffset(currentOffset)
+	kafkaReader.SetOffset(offset)
 	return kafkaReader
 }
 
-func createKafkaReaderConfig() kafkaGo.ReaderConfig {
-	kafkaConfig := utils.GetKafkaConfig()
+func createKafkaReaderConfig(kafkaConfig *utils.KafkaConfig) kafkaGo.ReaderConfig {
 	kafkaDialer := createKafkaDialer(kafkaConfig)
 	return kafkaGo.ReaderConfig{
 		Brokers: kafkaConfig.Brokers,
@@ -35,25 +46,72 @@ func createKafkaReaderConfig() kafkaGo.ReaderConfig {
 
 func createKafkaDialer(kafkaConfig *utils.KafkaConfig) *kafkaGo.Dialer {
 	return &kafkaGo.Dialer{
-		Timeout:   10 * time.Second,
-		DualStack: true,
-		SASLMechanism: plain.Mechanism{
-			Username: kafkaConfig.Username,
-			Password: kafkaConfig.Password,
-		},
-		TLS: &tls.Config{},
+		Timeout:       10 * time.Second,
+		DualStack:     true,
+		SASLMechanism: currentPasswordMechanism{username: kafkaConfig.Username},
+		TLS:           &tls.Config{},
 	}
 }
 
-func getCurrentOffset() int64 {
-	lastOffsetRecorded, offsetErr := utils.ReadOffset()
-	if offsetErr != nil {
-		logrus.WithFields(logrus.Fields{
-			"Error": offsetErr.Error(),
-		}).Fatal("Unable to retrieve offset")
+// currentPasswordMechanism is SASL PLAIN with the password looked up on every
+// dial, so long-lived readers and writers use a rotated CAP_KAFKA_PASSWORD
+// the next time they connect.
+type currentPasswordMechanism struct {
+	username string
+}
+
+func (mechanism currentPasswordMechanism) Name() string {
+	return plain.Mechanism{}.Name()
+}
+
+func (mechanism currentPasswordMechanism) Start(ctx context.Context) (sasl.StateMachine, []byte, error) {
+	return plain.Mechanism{
+		Username: mechanism.username,
+		Password: utils.GetKafkaPassword(),
+	}.Start(ctx)
+}
+
+func lookupPartitions(kafkaConfig *utils.KafkaConfig) ([]int, error) {
+	kafkaDialer := createKafkaDialer(kafkaConfig)
+	contextWithTimeout, cancelTimeout := context.WithTimeout(context.Background(), partition_lookup_timeout)
+	defer cancelTimeout()
+	lookupErr := errors.New("No kafka brokers configured")
+	for _, broker := range kafkaConfig.Brokers {
+		var partitions []kafkaGo.Partition
+		partitions, lookupErr = kafkaDialer.LookupPartitions(contextWithTimeout, "tcp", broker, kafkaConfig.Topic)
+		if lookupErr == nil {
+			partitionIDs := []int{}
+			for _, partition := range partitions {
+				partitionIDs = append(partitionIDs, partition.ID)
+			}
+			sort.Ints(partitionIDs)
+			return partitionIDs, nil
+		}
+	}
+	return nil, lookupErr
+}
+
+func checkBrokers(kafkaConfig *utils.KafkaConfig) error {
+	kafkaDialer := createKafkaDialer(kafkaConfig)
+	contextWithTimeout, cancelTimeout := context.WithTimeout(context.Background(), broker_check_timeout)
+	defer cancelTimeout()
+	dialErr := errors.New("No kafka brokers configured")
+	for _, broker := range kafkaConfig.Brokers {
+		var conn *kafkaGo.Conn
+		conn, dialErr = kafkaDialer.DialContext(contextWithTimeout, "tcp", broker)
+		if dialErr == nil {
+			return conn.Close()
+		}
+	}
+	return dialErr
+}
+
+func nextOffset(offsets map[int]int64, partition int) int64 {
+	lastOffsetRecorded, found := offsets[partition]
+	if !found {
+		return kafkaGo.FirstOffset
 	}
-	currentOffset := lastOffsetRecorded + 1
-	return currentOffset
+	return lastOffsetRecorded + 1
 }
 
 func CloseKafkaReader(kafkaReader *kafkaGo.Reader) {
@@ -2,162 +2,319 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
+	"flag"
+	"fmt"
+	"github.com/opaas/capacity-worker/aliases"
 	"github.com/opaas/capacity-worker/client"
 	"github.com/opaas/capacity-worker/events"
+	"github.com/opaas/capacity-worker/health"
+	"github.com/opaas/capacity-worker/inventory"
 	"github.com/opaas/capacity-worker/kafka"
+	"github.com/opaas/capacity-worker/metrics"
+	"github.com/opaas/capacity-worker/softlayer"
 	"github.com/opaas/capacity-worker/utils"
+	"os"
 	"time"
 
 	kafkaGo "github.com/segmentio/kafka-go"
 	"github.com/sirupsen/logrus"
 )
 
-const (
-	batch_size           int           = 300
-	message_read_timeout time.Duration = 10 * time.Second
-)
-
 func init() {
 	utils.InitLogger()
-	envVarErr := utils.InitEnv()
-	if envVarErr != nil {
+}
+
+func loadConfig() {
+	_, configErr := utils.LoadConfig(flag.CommandLine)
+	if configErr != nil {
 		logrus.WithFields(logrus.Fields{
-			"Error": envVarErr,
+			"Error": configErr,
 		}).Fatal()
 	}
+	if aliasFile := utils.GetAliasFile(); aliasFile != "" {
+		aliasErr := aliases.Load(aliasFile, utils.GetAliasWatch())
+		if aliasErr != nil {
+			logrus.WithFields(logrus.Fields{
+				"Error": aliasErr,
+			}).Fatal()
+		}
+	}
 }
 
-func main() {
-	for {
-		messageBatch := readMessageBatchOrTimeout()
-		processMessageBatch(messageBatch)
-	}
+const (
+	replay_dead_letters_command string = "replay-dead-letters"
+	unknown_stream_archive_file string = "output/unknownStreams.jsonl"
+)
+
+var errBatchAbandoned = errors.New("Message batch abandoned during shutdown")
+
+type capacityWorker struct {
+	stopContext         context.Context
+	abandonContext      context.Context
+	deadLetterWriter    *kafka.DeadLetterWriter
+	failureBudget       int
+	unknownStreamPolicy string
+	exitCode            int
+}
+
+type archivedMessage struct {
+	Timestamp time.Time `json:"timestamp"`
+	Topic     string    `json:"topic"`
+	Partition int       `json:"partition"`
+	Offset    int64     `json:"offset"`
+	Reason    string    `json:"reason"`
+	Payload   string    `json:"payload"`
 }
 
-func readMessageBatchOrTimeout() []kafkaGo.Message {
-	logrus.Info("Reading messages from kafka with timeout value of ", message_read_timeout.String())
-	kafkaReader := kafka.NewKafkaReader()
-	//defer kafkaReader.Close()
-	defer kafka.CloseKafkaReader(kafkaReader)
-	contextWithTimeout, cancelTimeout := context.WithTimeout(context.Background(), message_read_timeout)
-	defer cancelTimeout()
-	var messageBatch []kafkaGo.Message
-	for i := 0; i < batch_size; i++ {
-		message, readMessageErr := kafkaReader.ReadMessage(contextWithTimeout)
-		//message, readMessageErr := kafkaReader.ReadMessage(context.Background())
-		if readMessageErr != nil {
+func main() {
+	printConfig := flag.Bool("print-config", false, "print the effective configuration, with secrets redacted, and exit")
+	utils.RegisterConfigFlags(flag.CommandLine)
+	flag.Parse()
+	loadConfig()
+	if *printConfig {
+		printErr := utils.WriteConfig(os.Stdout)
+		if printErr != nil {
 			logrus.WithFields(logrus.Fields{
-				"Error": readMessageErr.Error(),
-			}).Info()
-			break
+				"Error": printErr.Error(),
+			}).Fatal("Unable to print configuration")
 		}
-		messageBatch = append(messageBatch, message)
+		os.Exit(exit_code_clean)
 	}
-	return messageBatch
-}
-
-func processMessageBatch(messageBatch []kafkaGo.Message) {
-	if len(messageBatch) == 0 {
-		logrus.Info("No new messages read from kafka")
-		return
+	if utils.IsDryRun() {
+		logrus.Warn("Running in dry run mode, patches are recorded instead of sent")
 	}
+	stopContext, abandonContext := trapShutdownSignals(utils.GetShutdownGracePeriod())
+	httpServer := startHTTPServer(utils.GetHTTPListenAddress(), utils.GetLivenessTimeout())
+	inventory.Start(stopContext, utils.GetInventoryTTL(), utils.GetSoftLayerTTL())
+	worker := &capacityWorker{
+		stopContext:         stopContext,
+		abandonContext:      abandonContext,
+		deadLetterWriter:    kafka.NewDeadLetterWriter(),
+		failureBudget:       utils.GetFailureBudget(),
+		unknownStreamPolicy: utils.GetUnknownStreamPolicy(),
+		exitCode:            exit_code_clean,
+	}
+	if flag.Arg(0) == replay_dead_letters_command {
+		worker.replayDeadLetters()
+	} else {
+		worker.consumeMessages()
+	}
+	worker.deadLetterWriter.Close()
+	stopHTTPServer(httpServer)
 	logrus.WithFields(logrus.Fields{
-		"messageBatchLength": len(messageBatch),
-	}).Info("Processing message batch")
-	batchOpaasData := getOpaasData()
-	SlData := utils.GetSLData()
-	for _, message := range messageBatch {
-		logrus.Info("Printing the message %s ", message.Topic)
-		processMessage(message, batchOpaasData, SlData)
-		offsetErr := utils.WriteOffset(message.Offset)
-		if offsetErr != nil {
-			logrus.Fatal("Unable to write offset to file")
-		}
+		"exitCode": worker.exitCode,
+	}).Info("Worker stopped")
+	os.Exit(worker.exitCode)
+}
+
+func (worker *capacityWorker) consumeMessages() {
+	consumer := kafka.NewConsumer()
+	events.StartSnapshotReconciler(worker.stopContext)
+	health.RegisterReadinessCheck("kafka", consumer.CheckBrokers)
+	health.RegisterReadinessCheck("offsetStore", consumer.CheckOffsetStore)
+	runErr := consumer.Run(worker.stopContext, worker.batchHandler(consumer))
+	if runErr != nil {
+		logrus.WithFields(logrus.Fields{
+			"Error": runErr.Error(),
+		}).Error("Stopped consuming messages")
+		worker.exitCode = exit_code_failure_budget
 	}
+	consumer.Close()
 }
 
-func getOpaasData() *client.OpaasData {
-	opaasAPI := client.NewOpaasApi()
-	instances, instErr := opaasAPI.GetInstances()
-	if instErr != nil {
+func (worker *capacityWorker) replayDeadLetters() {
+	replayer, replayerErr := kafka.NewDeadLetterReplayer()
+	if replayerErr != nil {
 		logrus.WithFields(logrus.Fields{
-			"Error": instErr.Error(),
-		}).Fatal("Unable to retrieve instances")
+			"Error": replayerErr.Error(),
+		}).Fatal("Unable to replay dead letters")
 	}
-	storage, storageErr := opaasAPI.GetStorage()
-	if storageErr != nil {
+	replayErr := replayer.Run(worker.stopContext, worker.batchHandler(replayer))
+	if worker.stopContext.Err() != nil {
+		logrus.Info("Dead letter replay interrupted by shutdown")
+		return
+	}
+	if replayErr != nil {
 		logrus.WithFields(logrus.Fields{
-			"Error": storageErr.Error(),
-		}).Fatal("Unable to retrieve storage")
+			"Error": replayErr.Error(),
+		}).Error("Failed to replay dead letters")
+		worker.exitCode = exit_code_failure_budget
+		return
 	}
-	clusters, clustErr := opaasAPI.GetClusters()
-	if clustErr != nil {
+	logrus.Info("Finished replaying dead letters")
+}
+
+func (worker *capacityWorker) batchHandler(committer kafka.Committer) kafka.BatchHandler {
+	return func(messageBatch []kafkaGo.Message) error {
+		return worker.processMessageBatchWithRetry(committer, messageBatch)
+	}
+}
+
+// processMessageBatchWithRetry retries the uncommitted remainder of a batch
+// with exponential backoff and only returns an error once the failure budget
+// is spent.
+func (worker *capacityWorker) processMessageBatchWithRetry(committer kafka.Committer, messageBatch []kafkaGo.Message) error {
+	batchStart := time.Now()
+	metrics.BatchSize.Observe(float64(len(messageBatch)))
+	defer func() {
+		metrics.BatchDuration.Observe(time.Since(batchStart).Seconds())
+	}()
+	for attempt := 1; ; attempt++ {
+		health.Beat()
+		processedCount, batchErr := worker.processMessageBatch(committer, messageBatch)
+		messageBatch = messageBatch[processedCount:]
+		if batchErr == nil {
+			return nil
+		}
+		if batchErr == errBatchAbandoned {
+			worker.exitCode = exit_code_abandoned_batch
+			return nil
+		}
+		if attempt >= worker.failureBudget {
+			return fmt.Errorf("Failure budget of %d attempts exhausted: %w", worker.failureBudget, batchErr)
+		}
+		batchConfig := utils.GetBatchConfig()
+		backoff := utils.ExponentialBackoff(attempt, batchConfig.RetryBackoffMin, batchConfig.RetryBackoffMax)
 		logrus.WithFields(logrus.Fields{
-			"Error": clustErr.Error(),
-		}).Fatal("Unable to retrieve clusters")
+			"Error":             batchErr.Error(),
+			"attempt":           attempt,
+			"failureBudget":     worker.failureBudget,
+			"backoff":           backoff.String(),
+			"remainingMessages": len(messageBatch),
+		}).Error("Failed to process message batch, retrying")
+		select {
+		case <-time.After(backoff):
+		case <-worker.stopContext.Done():
+			logrus.WithFields(logrus.Fields{
+				"remainingMessages": len(messageBatch),
+			}).Warn("Abandoning failed message batch during shutdown")
+			worker.exitCode = exit_code_abandoned_batch
+			return nil
+		}
+	}
+}
+
+// processMessageBatch returns how many messages from the start of the batch
+// were processed and committed before it stopped. The offsets committed are
+// flushed once, whether or not the batch stopped early.
+func (worker *capacityWorker) processMessageBatch(committer kafka.Committer, messageBatch []kafkaGo.Message) (int, error) {
+	processedCount, batchErr := worker.processMessages(committer, messageBatch)
+	flushErr := committer.Flush()
+	if flushErr == nil {
+		return processedCount, batchErr
 	}
-	clusterhosts, clusterhostErr := opaasAPI.GetClusterhosts()
-	if clusterhostErr != nil {
+	if batchErr != nil {
 		logrus.WithFields(logrus.Fields{
-			"Error": clusterhostErr.Error(),
-		}).Fatal("Unable to retrieve clusterhosts")
+			"Error": flushErr.Error(),
+		}).Error("Unable to save message offsets")
+		return processedCount, batchErr
 	}
-	return &client.OpaasData{
-		Instances:    instances,
-		Storage:      storage,
-		Clusters:     clusters,
-		Clusterhosts: clusterhosts,
+	return processedCount, fmt.Errorf("Unable to save message offsets: %w", flushErr)
+}
+
+// processMessages returns how many messages from the start of the batch
+// were processed and committed before it stopped. A message whose patches
+// failed for a reason a retry may fix is not committed, so the retry starts
+// from it; any other failed message is dead-lettered and committed.
+func (worker *capacityWorker) processMessages(committer kafka.Committer, messageBatch []kafkaGo.Message) (int, error) {
+	logrus.WithFields(logrus.Fields{
+		"messageBatchLength": len(messageBatch),
+	}).Info("Processing message batch")
+	snapshot, inventoryErr := inventory.Get(worker.abandonContext)
+	if inventoryErr != nil {
+		return 0, inventoryErr
+	}
+	for i, message := range messageBatch {
+		health.Beat()
+		if worker.abandonContext.Err() != nil {
+			logrus.WithFields(logrus.Fields{
+				"remainingMessages": len(messageBatch) - i,
+				"nextOffset":        message.Offset,
+				"partition":         message.Partition,
+			}).Warn("Abandoning message batch, remaining messages were not committed")
+			return i, errBatchAbandoned
+		}
+		logrus.WithFields(logrus.Fields{
+			"topic":     message.Topic,
+			"partition": message.Partition,
+			"offset":    message.Offset,
+		}).Info("Processing message")
+		processErr := processMessage(message, snapshot.Opaas, snapshot.SoftLayer)
+		var patchErr *events.PatchError
+		if errors.As(processErr, &patchErr) && patchErr.Temporary() {
+			return i, fmt.Errorf("Unable to patch OPaaS for offset %d: %w", message.Offset, processErr)
+		}
+		if processErr != nil {
+			failureErr := worker.handleFailedMessage(message, processErr)
+			if failureErr != nil {
+				return i, failureErr
+			}
+		}
+		commitErr := committer.Commit(message)
+		if commitErr != nil {
+			return i, fmt.Errorf("Unable to commit message offset: %w", commitErr)
+		}
 	}
+	return len(messageBatch), nil
 }
 
-func processMessage(message kafkaGo.Message, batchOpaasData *client.OpaasData, SlData []utils.SoftLayerHosts) {
+func processMessage(message kafkaGo.Message, batchOpaasData *client.OpaasData, SlData *softlayer.Data) (processErr error) {
 	offset := message.Offset
-	event, conversionErr := convertMessageToEvent(message)
+	event, conversionErr := events.ConvertToEvent(offset, message.Value)
 	if conversionErr != nil {
+		metrics.DecodeFailures.Inc()
 		logrus.WithFields(logrus.Fields{
 			"offset": offset,
 			"Error":  conversionErr.Error(),
 		}).Error("Problem occured while converting kafka message to usable event")
-		return
+		return conversionErr
 	}
 	logrus.WithFields(logrus.Fields{
 		"offset": offset,
 	}).Info("Successfully converted message to event. Beginning to process event")
-	event.Process(offset, batchOpaasData, SlData)
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			processErr = fmt.Errorf("Problem occured while processing event: %v", recovered)
+			logrus.WithFields(logrus.Fields{
+				"offset": offset,
+				"Error":  processErr.Error(),
+			}).Error()
+		}
+	}()
+	return event.Process(message.Partition, offset, batchOpaasData, SlData)
 }
 
-func convertMessageToEvent(message kafkaGo.Message) (events.Event, error) {
-	unknownEvent := kafka.KafkaEvent{}
-	unknownUnmarshallErr := json.Unmarshal(message.Value, &unknownEvent)
-	if unknownUnmarshallErr != nil {
-		return nil, unknownUnmarshallErr
+// handleFailedMessage sends a message that could not be processed to the
+// dead-letter topic, unless it failed only because no handler owns its
+// stream and CAP_UNKNOWN_STREAM_POLICY says otherwise.
+func (worker *capacityWorker) handleFailedMessage(message kafkaGo.Message, processErr error) error {
+	if errors.Is(processErr, events.ErrUnknownStream) {
+		switch worker.unknownStreamPolicy {
+		case utils.UnknownStreamDrop:
+			logrus.WithFields(logrus.Fields{
+				"offset": message.Offset,
+				"Error":  processErr.Error(),
+			}).Warn("Dropping message for unknown stream")
+			return nil
+		case utils.UnknownStreamArchive:
+			archiveErr := utils.AppendJSONLine(unknown_stream_archive_file, archivedMessage{
+				Timestamp: time.Now(),
+				Topic:     message.Topic,
+				Partition: message.Partition,
+				Offset:    message.Offset,
+				Reason:    processErr.Error(),
+				Payload:   string(message.Value),
+			})
+			if archiveErr != nil {
+				return fmt.Errorf("Unable to archive message for unknown stream: %w", archiveErr)
+			}
+			return nil
+		}
 	}
-	event, findCorrectEventTypeErr := findCorrectEventType(unknownEvent)
-	if findCorrectEventTypeErr != nil {
-		return nil, findCorrectEventTypeErr
+	publishErr := worker.deadLetterWriter.Publish(message, processErr)
+	if publishErr != nil {
+		return fmt.Errorf("Unable to publish message to dead-letter topic: %w", publishErr)
 	}
-	eventUnmarshalErr := json.Unmarshal(message.Value, event)
-	return event, eventUnmarshalErr
-}
-
-func findCorrectEventType(unknownEvent kafka.KafkaEvent) (events.Event, error) {
-	var event events.Event = nil
-	var err error = nil
-	switch unknownEvent.StreamName {
-	case "xseries.datastore":
-		event = &events.DatastoreEvent{}
-	case "xseries.vminfo":
-		event = &events.VMEvent{}
-	case "xseries.esx_cluster":
-		event = &events.ClusterEvent{}
-	case "xseries.resource_pool":
-		event = &events.ClusterEvent{}
-	case "xseries.esx_host":
-		event = &events.ClusterHostEvent{}
-	default:
-		err = errors.New("No operation defined for provided StreamName")
-	}
-	return event, err
+	return nil
 }
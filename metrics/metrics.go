@@ -0,0 +1,92 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace string = "capacity_worker"
+
+var (
+	MessagesConsumed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_consumed_total",
+		Help:      "Kafka messages consumed, by streamName, with streams without a handler counted as unknown.",
+	}, []string{"stream"})
+
+	DecodeFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "decode_failures_total",
+		Help:      "Kafka messages that could not be converted to an event.",
+	})
+
+	RejectedRecords = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rejected_records_total",
+		Help:      "Records quarantined because they failed schema validation, by streamName.",
+	}, []string{"stream"})
+
+	BatchSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "batch_size_messages",
+		Help:      "Number of messages in each processed batch.",
+		Buckets:   []float64{1, 5, 10, 25, 50, 100, 200, 300, 500, 1000},
+	})
+
+	BatchDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "batch_duration_seconds",
+		Help:      "Time taken to process a batch, including retries.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+	})
+
+	OpaasRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "opaas_requests_total",
+		Help:      "Requests made to the OPaaS API, by endpoint, method and status.",
+	}, []string{"endpoint", "method", "status"})
+
+	OpaasRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "opaas_request_duration_seconds",
+		Help:      "Latency of requests made to the OPaaS API.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint", "method"})
+
+	PatchesIssued = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "patches_issued_total",
+		Help:      "Patch operations sent to OPaaS, by patch path and result.",
+	}, []string{"path", "result"})
+
+	SlackMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "slack_messages_total",
+		Help:      "Slack messages sent, by message kind and result.",
+	}, []string{"kind", "result"})
+
+	ClusterhostMismatches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "clusterhost_mismatches_total",
+		Help:      "Clusterhosts whose SoftLayer hardware disagrees with vCenter or their profile, by kind.",
+	}, []string{"kind"})
+
+	UnknownSites = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "unknown_sites_total",
+		Help:      "Records from a site that has no alias and is not known to OPaaS, by site.",
+	}, []string{"site"})
+
+	ConsumerLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "consumer_lag_messages",
+		Help:      "Messages between the reader position and the partition high-water mark.",
+	}, []string{"topic", "partition"})
+)
+
+func Result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/opaas/capacity-worker/events"
+	"github.com/opaas/capacity-worker/health"
+	"github.com/opaas/capacity-worker/utils"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+const http_shutdown_timeout time.Duration = 5 * time.Second
+
+func startHTTPServer(listenAddress string, livenessTimeout time.Duration) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/healthz", health.LivenessHandler(livenessTimeout))
+	mux.Handle("/readyz", health.ReadinessHandler())
+	mux.Handle("/clusterhosts/pending", requireAdminToken(pendingClusterhostsHandler))
+	mux.Handle("/clusterhosts/approve", requireAdminToken(approveClusterhostHandler))
+	httpServer := &http.Server{
+		Addr:    listenAddress,
+		Handler: mux,
+	}
+	go func() {
+		logrus.WithFields(logrus.Fields{
+			"address": listenAddress,
+		}).Info("Starting HTTP server")
+		serveErr := httpServer.ListenAndServe()
+		if serveErr != nil && serveErr != http.ErrServerClosed {
+			logrus.WithFields(logrus.Fields{
+				"Error": serveErr.Error(),
+			}).Error("HTTP server stopped")
+		}
+	}()
+	return httpServer
+}
+
+func stopHTTPServer(httpServer *http.Server) {
+	contextWithTimeout, cancelTimeout := context.WithTimeout(context.Background(), http_shutdown_timeout)
+	defer cancelTimeout()
+	shutdownErr := httpServer.Shutdown(contextWithTimeout)
+	if shutdownErr != nil {
+		logrus.WithFields(logrus.Fields{
+			"Error": shutdownErr.Error(),
+		}).Info("Error stopping HTTP server")
+	}
+}
+
+// requireAdminToken only lets requests through that carry CAP_ADMIN_TOKEN as
+// a bearer token. The endpoints share a listener with /metrics, which
+// scrapers can reach, so without a token they answer 403 to everyone.
+func requireAdminToken(handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		adminToken := utils.GetAdminToken()
+		if adminToken == "" {
+			http.Error(responseWriter, "Forbidden, CAP_ADMIN_TOKEN is not set", http.StatusForbidden)
+			return
+		}
+		bearerToken := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(bearerToken), []byte(adminToken)) != 1 {
+			responseWriter.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(responseWriter, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(responseWriter, request)
+	})
+}
+
+func pendingClusterhostsHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	pending, pendingErr := events.PendingClusterhosts()
+	if pendingErr != nil {
+		http.Error(responseWriter, pendingErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	responseWriter.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(responseWriter).Encode(pending)
+}
+
+// approveClusterhostHandler approves the host named by the hostName query
+// parameter, e.g. POST /clusterhosts/approve?hostName=esx01.example.com
+func approveClusterhostHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		responseWriter.Header().Set("Allow", http.MethodPost)
+		http.Error(responseWriter, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	hostName := request.URL.Query().Get("hostName")
+	if hostName == "" {
+		http.Error(responseWriter, "hostName is required", http.StatusBadRequest)
+		return
+	}
+	approveErr := events.ApproveClusterhost(hostName)
+	if errors.Is(approveErr, events.ErrClusterhostNotPending) {
+		http.Error(responseWriter, approveErr.Error(), http.StatusNotFound)
+		return
+	}
+	if approveErr != nil {
+		http.Error(responseWriter, approveErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	responseWriter.WriteHeader(http.StatusNoContent)
+}
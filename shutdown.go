@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	exit_code_clean           int = 0
+	exit_code_abandoned_batch int = 3
+	exit_code_forced          int = 4
+	exit_code_failure_budget  int = 5
+
+	forced_exit_delay time.Duration = 5 * time.Second
+)
+
+// trapShutdownSignals returns a context that is cancelled on the first SIGINT
+// or SIGTERM, telling the worker to stop fetching, and a second context that
+// is cancelled once the grace period expires or a second signal arrives,
+// telling it to abandon the batch in flight. If the worker still has not
+// exited shortly after that, the process is terminated.
+func trapShutdownSignals(gracePeriod time.Duration) (context.Context, context.Context) {
+	stopContext, stop := context.WithCancel(context.Background())
+	abandonContext, abandon := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		received := <-signals
+		logrus.WithFields(logrus.Fields{
+			"signal":      received.String(),
+			"gracePeriod": gracePeriod.String(),
+		}).Info("Received shutdown signal, finishing current batch")
+		stop()
+		select {
+		case <-time.After(gracePeriod):
+			logrus.Warn("Shutdown grace period expired, abandoning current batch")
+		case received = <-signals:
+			logrus.WithFields(logrus.Fields{
+				"signal": received.String(),
+			}).Warn("Received second shutdown signal, abandoning current batch")
+		}
+		abandon()
+		time.Sleep(forced_exit_delay)
+		logrus.WithFields(logrus.Fields{
+			"exitCode": exit_code_forced,
+		}).Error("Worker did not stop after abandoning current batch, forcing exit")
+		os.Exit(exit_code_forced)
+	}()
+	return stopContext, abandonContext
+}
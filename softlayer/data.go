@@ -0,0 +1,76 @@
+package softlayer
+
+type Location struct {
+	Name string `json:"name"`
+}
+
+type HardwareStatus struct {
+	Status string `json:"status"`
+}
+
+// Hardware is a bare metal server on the account, as far as the object mask
+// in GetHardware asks for it. MemoryGB is SoftLayer's memoryCapacity, which is
+// in gigabytes.
+type Hardware struct {
+	ID             int             `json:"id"`
+	FQDN           string          `json:"fullyQualifiedDomainName"`
+	Datacenter     *Location       `json:"datacenter,omitempty"`
+	ProcessorCores int             `json:"processorPhysicalCoreAmount"`
+	MemoryGB       int             `json:"memoryCapacity"`
+	HardwareStatus *HardwareStatus `json:"hardwareStatus,omitempty"`
+	PrimaryIP      string          `json:"primaryIpAddress"`
+}
+
+// DatacenterName returns "" when SoftLayer did not say where the server is.
+func (hardware *Hardware) DatacenterName() string {
+	if hardware.Datacenter == nil {
+		return ""
+	}
+	return hardware.Datacenter.Name
+}
+
+func (hardware *Hardware) Status() string {
+	if hardware.HardwareStatus == nil {
+		return ""
+	}
+	return hardware.HardwareStatus.Status
+}
+
+// Data holds the SoftLayer hardware list with an index by FQDN, built once
+// per snapshot.
+type Data struct {
+	Hardware []Hardware
+	byFQDN   map[string]*Hardware
+}
+
+func NewData(hardware []Hardware) *Data {
+	byFQDN := make(map[string]*Hardware, len(hardware))
+	for i := range hardware {
+		if _, found := byFQDN[hardware[i].FQDN]; !found {
+			byFQDN[hardware[i].FQDN] = &hardware[i]
+		}
+	}
+	return &Data{
+		Hardware: hardware,
+		byFQDN:   byFQDN,
+	}
+}
+
+// HardwareByFQDN is safe to call on nil, which is what a snapshot holds when
+// SoftLayer could not be read.
+func (slData *Data) HardwareByFQDN(fqdn string) (*Hardware, bool) {
+	if slData == nil {
+		return nil, false
+	}
+	hardware, found := slData.byFQDN[fqdn]
+	return hardware, found
+}
+
+// ServerID returns the hardware ID for an FQDN.
+func (slData *Data) ServerID(fqdn string) (int, bool) {
+	hardware, found := slData.HardwareByFQDN(fqdn)
+	if !found {
+		return 0, false
+	}
+	return hardware.ID, true
+}
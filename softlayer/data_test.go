@@ -0,0 +1,43 @@
+package softlayer
+
+import "testing"
+
+// scanServerID is the lookup ServerID replaced.
+func scanServerID(hardware []Hardware, fqdn string) (int, bool) {
+	for _, host := range hardware {
+		if host.FQDN == fqdn {
+			return host.ID, true
+		}
+	}
+	return 0, false
+}
+
+func TestServerIDMatchesLinearScan(t *testing.T) {
+	hardware := []Hardware{
+		{ID: 1, FQDN: "host1.example.com"},
+		{ID: 2, FQDN: "host2.example.com"},
+		{ID: 3, FQDN: "host1.example.com"},
+		{ID: 4, FQDN: ""},
+	}
+	slData := NewData(hardware)
+	for _, fqdn := range []string{"host1.example.com", "host2.example.com", "HOST2.example.com", "host3.example.com", ""} {
+		gotID, gotFound := slData.ServerID(fqdn)
+		wantID, wantFound := scanServerID(hardware, fqdn)
+		if gotID != wantID || gotFound != wantFound {
+			t.Errorf("ServerID(%q) = %d, %v, want %d, %v", fqdn, gotID, gotFound, wantID, wantFound)
+		}
+	}
+	if got, _ := slData.HardwareByFQDN("host1.example.com"); got != &slData.Hardware[0] {
+		t.Errorf("HardwareByFQDN() = %p, want the first record in the snapshot %p", got, &slData.Hardware[0])
+	}
+}
+
+func TestLookupsOnMissingData(t *testing.T) {
+	var slData *Data
+	if _, found := slData.ServerID("host1.example.com"); found {
+		t.Error("ServerID on nil data found a server")
+	}
+	if _, found := slData.HardwareByFQDN("host1.example.com"); found {
+		t.Error("HardwareByFQDN on nil data found hardware")
+	}
+}
@@ -0,0 +1,69 @@
+package softlayer
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrNotConfigured is returned by NewClient when CAP_SOFTLAYER_USERNAME and
+// CAP_SOFTLAYER_API_KEY are not set.
+var ErrNotConfigured = errors.New("SoftLayer credentials are not configured")
+
+// ErrTooManyPages is returned when a list method has not ended after
+// max_pages pages.
+var ErrTooManyPages = errors.New("SoftLayer listing did not end")
+
+// APIError is returned for any SoftLayer response outside 2xx. Code is the
+// SoftLayer exception class, e.g. SoftLayer_Exception_InvalidLegacyToken.
+type APIError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (apiErr *APIError) Error() string {
+	if apiErr.Code == "" {
+		return fmt.Sprintf("SoftLayer returned %d: %s", apiErr.StatusCode, apiErr.Message)
+	}
+	return fmt.Sprintf("SoftLayer returned %d %s: %s", apiErr.StatusCode, apiErr.Code, apiErr.Message)
+}
+
+// RequestError is returned when SoftLayer could not be reached or its answer
+// could not be read.
+type RequestError struct {
+	Method string
+	Err    error
+}
+
+func (requestErr *RequestError) Error() string {
+	return fmt.Sprintf("SoftLayer request %s failed: %v", requestErr.Method, requestErr.Err)
+}
+
+func (requestErr *RequestError) Unwrap() error {
+	return requestErr.Err
+}
+
+// DecodeError is returned when a 2xx answer is not the JSON that was asked
+// for.
+type DecodeError struct {
+	Method string
+	Err    error
+}
+
+func (decodeErr *DecodeError) Error() string {
+	return fmt.Sprintf("Unable to decode SoftLayer %s response: %v", decodeErr.Method, decodeErr.Err)
+}
+
+func (decodeErr *DecodeError) Unwrap() error {
+	return decodeErr.Err
+}
+
+// IsUnauthorized reports whether SoftLayer rejected the API username or key.
+func IsUnauthorized(err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden
+}
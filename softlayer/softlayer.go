@@ -0,0 +1,136 @@
+package softlayer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/opaas/capacity-worker/utils"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	hardware_method string = "SoftLayer_Account/getHardware"
+	hardware_mask   string = "mask[id,fullyQualifiedDomainName,primaryIpAddress,processorPhysicalCoreAmount,memoryCapacity,datacenter[name],hardwareStatus[status]]"
+	total_header    string = "SoftLayer-Total-Items"
+
+	// max_pages bounds a listing whose API keeps returning full pages.
+	max_pages int = 1000
+)
+
+// Client calls the SoftLayer REST API with an API username and key.
+type Client struct {
+	config     *utils.SoftLayerConfig
+	httpClient *http.Client
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+// NewClient returns ErrNotConfigured if no credentials are set, so callers
+// can run without SoftLayer.
+func NewClient() (*Client, error) {
+	config := utils.GetSoftLayerConfig()
+	if config.Username == "" || config.APIKey == "" {
+		return nil, ErrNotConfigured
+	}
+	return &Client{
+		config:     config,
+		httpClient: &http.Client{Timeout: config.Timeout},
+	}, nil
+}
+
+// GetHardware reads every hardware on the account, CAP_SOFTLAYER_PAGE_SIZE at
+// a time. Only the fields Hardware declares are requested. Paging stops at a
+// short page, at the total SoftLayer reports, or at a page without any new
+// ID, which is what an API that ignores the offset sends. More than
+// max_pages pages is an error.
+func (slClient *Client) GetHardware(ctx context.Context) ([]Hardware, error) {
+	hardware := []Hardware{}
+	seen := make(map[int]bool)
+	pageSize := slClient.config.PageSize
+	offset := 0
+	for pages := 0; pages < max_pages; pages++ {
+		page := []Hardware{}
+		total, getErr := slClient.get(ctx, hardware_method, hardware_mask, offset, pageSize, &page)
+		if getErr != nil {
+			return nil, getErr
+		}
+		newItems := 0
+		for _, item := range page {
+			if !seen[item.ID] {
+				seen[item.ID] = true
+				hardware = append(hardware, item)
+				newItems++
+			}
+		}
+		offset += len(page)
+		if len(page) < pageSize || (total >= 0 && offset >= total) {
+			return hardware, nil
+		}
+		if newItems == 0 {
+			logrus.WithFields(logrus.Fields{
+				"method": hardware_method,
+				"offset": offset,
+			}).Warn("SoftLayer returned a page without new items, stopped paging")
+			return hardware, nil
+		}
+	}
+	return nil, fmt.Errorf("%s: %w after %d pages", hardware_method, ErrTooManyPages, max_pages)
+}
+
+// get calls one page of a list method and returns the total number of items
+// SoftLayer reports, or -1 if it did not send one.
+func (slClient *Client) get(ctx context.Context, method string, mask string, offset int, limit int, output interface{}) (int, error) {
+	query := url.Values{
+		"objectMask":  {mask},
+		"resultLimit": {fmt.Sprintf("%d,%d", offset, limit)},
+	}
+	requestURL := fmt.Sprintf("%s/%s.json?%s", slClient.config.BaseURL, method, query.Encode())
+	request, requestErr := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+	if requestErr != nil {
+		return 0, &RequestError{Method: method, Err: requestErr}
+	}
+	request.SetBasicAuth(slClient.config.Username, utils.GetSoftLayerAPIKey())
+	request.Header.Set("Accept", "application/json")
+	response, responseErr := slClient.httpClient.Do(request)
+	if responseErr != nil {
+		return 0, &RequestError{Method: method, Err: responseErr}
+	}
+	defer response.Body.Close()
+	body, readErr := ioutil.ReadAll(response.Body)
+	if readErr != nil {
+		return 0, &RequestError{Method: method, Err: readErr}
+	}
+	if response.StatusCode/100 != 2 {
+		return 0, newAPIError(response.StatusCode, body)
+	}
+	unmarshalErr := json.Unmarshal(body, output)
+	if unmarshalErr != nil {
+		return 0, &DecodeError{Method: method, Err: unmarshalErr}
+	}
+	total, atoiErr := strconv.Atoi(response.Header.Get(total_header))
+	if atoiErr != nil {
+		return -1, nil
+	}
+	return total, nil
+}
+
+func newAPIError(statusCode int, body []byte) *APIError {
+	apiErr := &APIError{
+		StatusCode: statusCode,
+		Message:    http.StatusText(statusCode),
+	}
+	slError := errorResponse{}
+	if json.Unmarshal(body, &slError) == nil && slError.Error != "" {
+		apiErr.Code = slError.Code
+		apiErr.Message = slError.Error
+	}
+	return apiErr
+}
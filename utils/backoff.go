@@ -0,0 +1,24 @@
+package utils
+
+import (
+	"math/rand"
+	"time"
+)
+
+func ExponentialBackoff(attempt int, minBackoff time.Duration, maxBackoff time.Duration) time.Duration {
+	backoff := minBackoff
+	for i := 1; i < attempt && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		return maxBackoff
+	}
+	return backoff
+}
+
+// JitteredBackoff picks a random delay between half and all of the
+// exponential backoff, so clients retrying together spread out.
+func JitteredBackoff(attempt int, minBackoff time.Duration, maxBackoff time.Duration) time.Duration {
+	backoff := ExponentialBackoff(attempt, minBackoff, maxBackoff)
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
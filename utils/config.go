@@ -0,0 +1,434 @@
+package utils
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+const redacted_value string = "<redacted>"
+
+// setting is one configuration key. The same name is used in the
+// environment, in the config file and, lowercased with dashes, as a flag.
+// Secret settings also get a KEY_FILE setting, see secrets.go.
+type setting struct {
+	key          string
+	defaultValue interface{}
+	required     bool
+	secret       bool
+	usage        string
+}
+
+var settings = withSecretFiles([]setting{
+	{key: configFileEnv, usage: "YAML or JSON file with any of these settings"},
+	{key: slackTokenEnv, required: true, secret: true, usage: "Slack bot token"},
+	{key: slackChannelIdEnv, required: true, usage: "Slack channel for alerts"},
+	{key: opaasUrlEnv, required: true, usage: "OPaaS API base URL"},
+	{key: opaasKeyEnv, required: true, secret: true, usage: "OPaaS API key"},
+	{key: kafkaUsernameEnv, required: true, usage: "Kafka SASL username"},
+	{key: kafkaPasswordEnv, required: true, secret: true, usage: "Kafka SASL password"},
+	{key: kafkaTopicEnv, required: true, usage: "Kafka topic to consume"},
+	{key: kafkaBrokersEnv, required: true, usage: "Kafka brokers"},
+	{key: kafkaGroupIdEnv, usage: "Kafka consumer group, instead of the offset file"},
+	{key: kafkaDLQTopicEnv, usage: "Kafka dead-letter topic"},
+	{key: batchSizeEnv, defaultValue: 300, usage: "maximum messages per batch"},
+	{key: batchWindowEnv, defaultValue: 10 * time.Second, usage: "maximum time to fill a batch"},
+	{key: retryMinEnv, defaultValue: 1 * time.Second, usage: "first delay before a failed batch is retried"},
+	{key: retryMaxEnv, defaultValue: 2 * time.Minute, usage: "longest delay before a failed batch is retried"},
+	{key: failureBudgetEnv, defaultValue: 10, usage: "consecutive failed batch attempts before the worker stops"},
+	{key: gracePeriodEnv, defaultValue: 20 * time.Second, usage: "time to finish the batch in flight on shutdown"},
+	{key: httpAddressEnv, defaultValue: ":8080", usage: "address for /metrics, /healthz and /readyz"},
+	{key: livenessEnv, defaultValue: 5 * time.Minute, usage: "time without progress before /healthz fails"},
+	{key: dryRunEnv, defaultValue: false, usage: "record patches instead of sending them"},
+	{key: dryRunReportEnv, defaultValue: "output/dryRunPatches.jsonl", usage: "file dry-run patches are appended to"},
+	{key: unknownStreamEnv, defaultValue: UnknownStreamDeadLetter, usage: "drop, dead-letter or archive messages for unknown streams"},
+	{key: chApprovalEnv, defaultValue: false, usage: "hold new clusterhosts for approval"},
+	{key: chCreateWaitEnv, defaultValue: 1 * time.Hour, usage: "time a created clusterhost may take to appear in OPaaS before it is created again"},
+	{key: adminTokenEnv, secret: true, usage: "bearer token for the /clusterhosts endpoints"},
+	{key: chRemediationEnv, defaultValue: false, usage: "patch changed clusterhost server IDs"},
+	{key: chMissingEnv, defaultValue: 3, usage: "snapshots a clusterhost may be missing before it is reported"},
+	{key: chDecommissionEnv, defaultValue: false, usage: "decommission missing clusterhosts, not with CAP_KAFKA_GROUP_ID"},
+	{key: chQuietPeriodEnv, defaultValue: 15 * time.Minute, usage: "time without records before a clusterhost snapshot is complete"},
+	{key: inventoryTTLEnv, defaultValue: 1 * time.Minute, usage: "how long an inventory snapshot is served"},
+	{key: pageSizeEnv, defaultValue: 0, usage: "OPaaS list page size, 0 for none"},
+	{key: pageSizesEnv, usage: "OPaaS page sizes per endpoint, e.g. instances=500"},
+	{key: maxPagesEnv, defaultValue: 1000, usage: "most pages read from one OPaaS list"},
+	{key: opaasTimeoutEnv, defaultValue: 30 * time.Second, usage: "timeout of one OPaaS request"},
+	{key: opaasRetriesEnv, defaultValue: 3, usage: "retries of a failed OPaaS request"},
+	{key: opaasCABundleEnv, usage: "PEM file of CAs trusted for OPaaS"},
+	{key: opaasCertEnv, usage: "client certificate for OPaaS"},
+	{key: opaasKeyFileEnv, usage: "client certificate key for OPaaS"},
+	{key: opaasInsecureEnv, defaultValue: false, usage: "skip TLS verification for OPaaS"},
+	{key: patchParallelEnv, defaultValue: 8, usage: "OPaaS patches in flight at a time"},
+	{key: slURLEnv, defaultValue: "https://api.softlayer.com/rest/v3", usage: "SoftLayer REST API base URL"},
+	{key: slUsernameEnv, usage: "SoftLayer API username"},
+	{key: slAPIKeyEnv, secret: true, usage: "SoftLayer API key"},
+	{key: slPageSizeEnv, defaultValue: 100, usage: "SoftLayer hardware page size"},
+	{key: slTimeoutEnv, defaultValue: 60 * time.Second, usage: "timeout of one SoftLayer request"},
+	{key: slCacheTTLEnv, defaultValue: 1 * time.Hour, usage: "how long the SoftLayer hardware list is reused"},
+	{key: aliasFileEnv, usage: "YAML or JSON file of site, datacenter and pod aliases"},
+	{key: aliasWatchEnv, defaultValue: false, usage: "reload the alias file when it changes"},
+	{key: vaultAddressEnv, usage: "Vault address secrets are read from when not set otherwise"},
+	{key: vaultTokenEnv, secret: true, usage: "Vault token"},
+	{key: vaultPathEnv, usage: "Vault KV secret holding the secret settings, e.g. secret/data/capacity-worker"},
+	{key: vaultRefreshEnv, defaultValue: 5 * time.Minute, usage: "how long secrets read from Vault are reused"},
+})
+
+type OpaasConfig struct {
+	BaseURL          string          `json:"baseUrl"`
+	APIKey           string          `json:"apiKey"`
+	PageSize         int             `json:"pageSize"`
+	PageSizes        map[string]int  `json:"pageSizes"`
+	MaxPages         int             `json:"maxPages"`
+	PatchConcurrency int             `json:"patchConcurrency"`
+	HTTP             OpaasHTTPConfig `json:"http"`
+}
+
+type ClusterhostConfig struct {
+	Approval            bool          `json:"approval"`
+	CreateTimeout       time.Duration `json:"createTimeout"`
+	ServerIDRemediation bool          `json:"serverIdRemediation"`
+	MissingSnapshots    int           `json:"missingSnapshots"`
+	DecommissionMissing bool          `json:"decommissionMissing"`
+	SnapshotQuietPeriod time.Duration `json:"snapshotQuietPeriod"`
+}
+
+type AliasConfig struct {
+	File  string `json:"file"`
+	Watch bool   `json:"watch"`
+}
+
+// Config is every setting the worker reads. It is loaded once by LoadConfig
+// and read through the Get functions.
+type Config struct {
+	Kafka               KafkaConfig       `json:"kafka"`
+	Batch               BatchConfig       `json:"batch"`
+	Slack               SlackConfig       `json:"slack"`
+	Opaas               OpaasConfig       `json:"opaas"`
+	SoftLayer           SoftLayerConfig   `json:"softLayer"`
+	Clusterhosts        ClusterhostConfig `json:"clusterhosts"`
+	Aliases             AliasConfig       `json:"aliases"`
+	AdminToken          string            `json:"adminToken"`
+	FailureBudget       int               `json:"failureBudget"`
+	ShutdownGracePeriod time.Duration     `json:"shutdownGracePeriod"`
+	HTTPListenAddress   string            `json:"httpListenAddress"`
+	LivenessTimeout     time.Duration     `json:"livenessTimeout"`
+	DryRun              bool              `json:"dryRun"`
+	DryRunReport        string            `json:"dryRunReport"`
+	UnknownStreamPolicy string            `json:"unknownStreamPolicy"`
+	InventoryTTL        time.Duration     `json:"inventoryTTL"`
+}
+
+var (
+	configMutex   sync.Mutex
+	currentConfig = &Config{}
+)
+
+// RegisterConfigFlags adds a flag for every setting, e.g. -cap-batch-size for
+// CAP_BATCH_SIZE. Settings that default to a bool get a bool flag, so
+// -cap-dry-run needs no value.
+func RegisterConfigFlags(flagSet *flag.FlagSet) {
+	for _, setting := range settings {
+		if _, isBool := setting.defaultValue.(bool); isBool {
+			flagSet.Bool(flagName(setting.key), false, setting.usage)
+			continue
+		}
+		flagSet.String(flagName(setting.key), "", setting.usage)
+	}
+}
+
+func flagName(key string) string {
+	return strings.ToLower(strings.ReplaceAll(key, "_", "-"))
+}
+
+// LoadConfig reads the settings and validates them. Flags that were set in
+// flagSet win over the environment, which wins over the config file named by
+// CAP_CONFIG_FILE, which wins over the defaults. A .env file in the working
+// directory is loaded into the environment if there is one; variables that
+// are already set are not overridden.
+func LoadConfig(flagSet *flag.FlagSet) (*Config, error) {
+	if goDotErr := godotenv.Load(); goDotErr != nil && !os.IsNotExist(goDotErr) {
+		return nil, fmt.Errorf("Unable to read .env: %w", goDotErr)
+	}
+	for _, setting := range settings {
+		if setting.defaultValue != nil {
+			viper.SetDefault(setting.key, setting.defaultValue)
+		}
+		bindErr := viper.BindEnv(setting.key)
+		if bindErr != nil {
+			return nil, bindErr
+		}
+	}
+	if flagSet != nil {
+		applyFlags(flagSet)
+	}
+	if configFile := viper.GetString(configFileEnv); configFile != "" {
+		viper.SetConfigFile(configFile)
+		readErr := viper.ReadInConfig()
+		if readErr != nil {
+			return nil, fmt.Errorf("Unable to read config file: %w", readErr)
+		}
+	}
+	secretsErr := loadSecretSources()
+	if secretsErr != nil {
+		return nil, secretsErr
+	}
+	secrets := make(map[string]string)
+	for _, setting := range settings {
+		if setting.secret {
+			value, secretErr := readSecret(setting.key)
+			if secretErr != nil {
+				return nil, fmt.Errorf("Unable to read %s: %w", setting.key, secretErr)
+			}
+			secrets[setting.key] = value
+		}
+		isSet := viper.IsSet(setting.key) || secrets[setting.key] != ""
+		if setting.required && !isSet {
+			errMsg := fmt.Sprintf("%s is not set", setting.key)
+			return nil, errors.New(errMsg)
+		}
+	}
+	config, configErr := readConfig(secrets)
+	if configErr != nil {
+		return nil, configErr
+	}
+	validationErr := config.validate()
+	if validationErr != nil {
+		return nil, validationErr
+	}
+	configMutex.Lock()
+	currentConfig = config
+	configMutex.Unlock()
+	return config, nil
+}
+
+func applyFlags(flagSet *flag.FlagSet) {
+	keys := make(map[string]string, len(settings))
+	for _, setting := range settings {
+		keys[flagName(setting.key)] = setting.key
+	}
+	flagSet.Visit(func(setFlag *flag.Flag) {
+		if key, found := keys[setFlag.Name]; found {
+			viper.Set(key, setFlag.Value.String())
+		}
+	})
+}
+
+// loadSecretSources records where each secret setting is read from and sets
+// up the Vault provider if CAP_VAULT_ADDR is set.
+func loadSecretSources() error {
+	sources := make(map[string]secretSource)
+	for _, setting := range settings {
+		if !setting.secret {
+			continue
+		}
+		source := secretSource{
+			value: viper.GetString(setting.key),
+			file:  viper.GetString(setting.key + secret_file_suffix),
+		}
+		if source.value != "" && source.file != "" {
+			errMsg := fmt.Sprintf("Only one of %s and %s%s may be set", setting.key, setting.key, secret_file_suffix)
+			return errors.New(errMsg)
+		}
+		sources[setting.key] = source
+	}
+	setSecretSources(sources)
+	if vaultAddress := viper.GetString(vaultAddressEnv); vaultAddress != "" {
+		vaultPath := viper.GetString(vaultPathEnv)
+		if vaultPath == "" {
+			errMsg := fmt.Sprintf("%s must be set with %s", vaultPathEnv, vaultAddressEnv)
+			return errors.New(errMsg)
+		}
+		RegisterSecretProvider(newVaultSecretProvider(vaultAddress, vaultPath, viper.GetDuration(vaultRefreshEnv)))
+	}
+	return nil
+}
+
+func readConfig(secrets map[string]string) (*Config, error) {
+	pageSizes, pageSizesErr := parsePageSizes(viper.GetString(pageSizesEnv))
+	if pageSizesErr != nil {
+		return nil, pageSizesErr
+	}
+	return &Config{
+		Kafka: KafkaConfig{
+			Username: viper.GetString(kafkaUsernameEnv),
+			Password: secrets[kafkaPasswordEnv],
+			Topic:    viper.GetString(kafkaTopicEnv),
+			Brokers:  viper.GetStringSlice(kafkaBrokersEnv),
+			GroupID:  viper.GetString(kafkaGroupIdEnv),
+			DLQTopic: viper.GetString(kafkaDLQTopicEnv),
+		},
+		Batch: BatchConfig{
+			Size:            viper.GetInt(batchSizeEnv),
+			Window:          viper.GetDuration(batchWindowEnv),
+			RetryBackoffMin: viper.GetDuration(retryMinEnv),
+			RetryBackoffMax: viper.GetDuration(retryMaxEnv),
+		},
+		Slack: SlackConfig{
+			Token:     secrets[slackTokenEnv],
+			ChannelID: viper.GetString(slackChannelIdEnv),
+		},
+		Opaas: OpaasConfig{
+			BaseURL:          viper.GetString(opaasUrlEnv),
+			APIKey:           secrets[opaasKeyEnv],
+			PageSize:         viper.GetInt(pageSizeEnv),
+			PageSizes:        pageSizes,
+			MaxPages:         viper.GetInt(maxPagesEnv),
+			PatchConcurrency: viper.GetInt(patchParallelEnv),
+			HTTP: OpaasHTTPConfig{
+				Timeout:            viper.GetDuration(opaasTimeoutEnv),
+				MaxRetries:         viper.GetInt(opaasRetriesEnv),
+				CABundle:           viper.GetString(opaasCABundleEnv),
+				ClientCert:         viper.GetString(opaasCertEnv),
+				ClientKey:          viper.GetString(opaasKeyFileEnv),
+				InsecureSkipVerify: viper.GetBool(opaasInsecureEnv),
+			},
+		},
+		SoftLayer: SoftLayerConfig{
+			BaseURL:  viper.GetString(slURLEnv),
+			Username: viper.GetString(slUsernameEnv),
+			APIKey:   secrets[slAPIKeyEnv],
+			PageSize: viper.GetInt(slPageSizeEnv),
+			Timeout:  viper.GetDuration(slTimeoutEnv),
+			CacheTTL: viper.GetDuration(slCacheTTLEnv),
+		},
+		Clusterhosts: ClusterhostConfig{
+			Approval:            viper.GetBool(chApprovalEnv),
+			CreateTimeout:       viper.GetDuration(chCreateWaitEnv),
+			ServerIDRemediation: viper.GetBool(chRemediationEnv),
+			MissingSnapshots:    viper.GetInt(chMissingEnv),
+			DecommissionMissing: viper.GetBool(chDecommissionEnv),
+			SnapshotQuietPeriod: viper.GetDuration(chQuietPeriodEnv),
+		},
+		Aliases: AliasConfig{
+			File:  viper.GetString(aliasFileEnv),
+			Watch: viper.GetBool(aliasWatchEnv),
+		},
+		AdminToken:          secrets[adminTokenEnv],
+		FailureBudget:       viper.GetInt(failureBudgetEnv),
+		ShutdownGracePeriod: viper.GetDuration(gracePeriodEnv),
+		HTTPListenAddress:   viper.GetString(httpAddressEnv),
+		LivenessTimeout:     viper.GetDuration(livenessEnv),
+		DryRun:              viper.GetBool(dryRunEnv),
+		DryRunReport:        viper.GetString(dryRunReportEnv),
+		UnknownStreamPolicy: viper.GetString(unknownStreamEnv),
+		InventoryTTL:        viper.GetDuration(inventoryTTLEnv),
+	}, nil
+}
+
+func (config *Config) validate() error {
+	switch config.UnknownStreamPolicy {
+	case UnknownStreamDrop, UnknownStreamDeadLetter, UnknownStreamArchive:
+	default:
+		errMsg := fmt.Sprintf("%s must be one of %s, %s or %s", unknownStreamEnv, UnknownStreamDrop, UnknownStreamDeadLetter, UnknownStreamArchive)
+		return errors.New(errMsg)
+	}
+
+	atLeastOne := map[string]int{
+		batchSizeEnv:     config.Batch.Size,
+		failureBudgetEnv: config.FailureBudget,
+		chMissingEnv:     config.Clusterhosts.MissingSnapshots,
+		maxPagesEnv:      config.Opaas.MaxPages,
+		patchParallelEnv: config.Opaas.PatchConcurrency,
+		slPageSizeEnv:    config.SoftLayer.PageSize,
+	}
+	for key, value := range atLeastOne {
+		if value < 1 {
+			errMsg := fmt.Sprintf("%s must be at least 1", key)
+			return errors.New(errMsg)
+		}
+	}
+
+	if config.Batch.RetryBackoffMin > config.Batch.RetryBackoffMax {
+		errMsg := fmt.Sprintf("%s must not be longer than %s", retryMinEnv, retryMaxEnv)
+		return errors.New(errMsg)
+	}
+
+	positive := map[string]time.Duration{
+		chQuietPeriodEnv: config.Clusterhosts.SnapshotQuietPeriod,
+		chCreateWaitEnv:  config.Clusterhosts.CreateTimeout,
+	}
+	for key, value := range positive {
+		if value <= 0 {
+			errMsg := fmt.Sprintf("%s must be positive", key)
+			return errors.New(errMsg)
+		}
+	}
+
+	// Without a token nobody could approve the hosts held back.
+	if config.Clusterhosts.Approval && config.AdminToken == "" {
+		errMsg := fmt.Sprintf("%s must be set with %s", adminTokenEnv, chApprovalEnv)
+		return errors.New(errMsg)
+	}
+
+	// Without a topic every message for an unknown stream would be lost.
+	if config.UnknownStreamPolicy == UnknownStreamDeadLetter && config.Kafka.DLQTopic == "" {
+		errMsg := fmt.Sprintf("%s must be set when %s is %s", kafkaDLQTopicEnv, unknownStreamEnv, UnknownStreamDeadLetter)
+		return errors.New(errMsg)
+	}
+
+	// A replica in a consumer group only sees some partitions, and so only
+	// part of each clusterhost snapshot.
+	if config.Clusterhosts.DecommissionMissing && config.Kafka.GroupID != "" {
+		errMsg := fmt.Sprintf("%s cannot be used with %s", chDecommissionEnv, kafkaGroupIdEnv)
+		return errors.New(errMsg)
+	}
+
+	if (config.Opaas.HTTP.ClientCert == "") != (config.Opaas.HTTP.ClientKey == "") {
+		errMsg := fmt.Sprintf("%s and %s must be set together", opaasCertEnv, opaasKeyFileEnv)
+		return errors.New(errMsg)
+	}
+
+	if (config.SoftLayer.Username == "") != (config.SoftLayer.APIKey == "") {
+		errMsg := fmt.Sprintf("%s and %s must be set together", slUsernameEnv, slAPIKeyEnv)
+		return errors.New(errMsg)
+	}
+
+	return nil
+}
+
+// WriteConfig writes the effective value of every setting as KEY=value, in
+// the format of a .env file. Secrets that are set, however they were
+// provided, are written as <redacted>.
+func WriteConfig(writer io.Writer) error {
+	for _, setting := range settings {
+		value := formatSetting(viper.Get(setting.key))
+		if setting.secret {
+			value = currentSecret(setting.key)
+		}
+		if setting.secret && value != "" {
+			value = redacted_value
+		}
+		_, writeErr := fmt.Fprintf(writer, "%s=%s\n", setting.key, value)
+		if writeErr != nil {
+			return writeErr
+		}
+	}
+	return nil
+}
+
+func formatSetting(value interface{}) string {
+	switch typedValue := value.(type) {
+	case nil:
+		return ""
+	case []interface{}, []string:
+		return strings.Join(cast.ToStringSlice(typedValue), ",")
+	default:
+		return fmt.Sprint(typedValue)
+	}
+}
+
+func loadedConfig() *Config {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	return currentConfig
+}
@@ -0,0 +1,36 @@
+package utils
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type DryRunPatch struct {
+	Timestamp  time.Time   `json:"timestamp"`
+	Partition  int         `json:"partition"`
+	Offset     int64       `json:"offset"`
+	Model      string      `json:"model"`
+	TargetID   string      `json:"targetId"`
+	TargetName string      `json:"targetName"`
+	Op         string      `json:"op"`
+	Path       string      `json:"path"`
+	OldValue   interface{} `json:"oldValue"`
+	NewValue   interface{} `json:"newValue"`
+}
+
+func IsDryRun() bool {
+	return loadedConfig().DryRun
+}
+
+func RecordDryRunPatch(dryRunPatch DryRunPatch) {
+	logrus.WithFields(logrus.Fields{
+		"dryRunPatch": dryRunPatch,
+	}).Info("Dry run, not sending patch")
+	writeErr := AppendJSONLine(loadedConfig().DryRunReport, dryRunPatch)
+	if writeErr != nil {
+		logrus.WithFields(logrus.Fields{
+			"Error": writeErr.Error(),
+		}).Error("Failed to write dry run report")
+	}
+}
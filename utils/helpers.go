@@ -1,16 +1,17 @@
 package utils
 
 import (
-	"errors"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/joho/godotenv"
 	"github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
 )
 
 const (
+	configFileEnv     string = "CAP_CONFIG_FILE"
 	slackTokenEnv     string = "CAPACITY_SLACK_TOKEN"
 	slackChannelIdEnv string = "CAPACITY_SLACK_CHANNEL"
 	opaasUrlEnv       string = "OPAAS_BASE_URL"
@@ -19,6 +20,55 @@ const (
 	kafkaPasswordEnv  string = "CAP_KAFKA_PASSWORD"
 	kafkaTopicEnv     string = "CAP_KAFKA_TOPIC"
 	kafkaBrokersEnv   string = "CAP_KAFKA_BROKERS"
+	kafkaGroupIdEnv   string = "CAP_KAFKA_GROUP_ID"
+	kafkaDLQTopicEnv  string = "CAP_KAFKA_DLQ_TOPIC"
+	batchSizeEnv      string = "CAP_BATCH_SIZE"
+	batchWindowEnv    string = "CAP_BATCH_WINDOW"
+	retryMinEnv       string = "CAP_RETRY_BACKOFF_MIN"
+	retryMaxEnv       string = "CAP_RETRY_BACKOFF_MAX"
+	gracePeriodEnv    string = "CAP_SHUTDOWN_GRACE_PERIOD"
+	failureBudgetEnv  string = "CAP_FAILURE_BUDGET"
+	httpAddressEnv    string = "CAP_HTTP_LISTEN_ADDRESS"
+	livenessEnv       string = "CAP_LIVENESS_TIMEOUT"
+	dryRunEnv         string = "CAP_DRY_RUN"
+	dryRunReportEnv   string = "CAP_DRY_RUN_REPORT"
+	unknownStreamEnv  string = "CAP_UNKNOWN_STREAM_POLICY"
+	chApprovalEnv     string = "CAP_CLUSTERHOST_APPROVAL"
+	chRemediationEnv  string = "CAP_SERVER_ID_REMEDIATION"
+	chMissingEnv      string = "CAP_MISSING_CLUSTERHOST_SNAPSHOTS"
+	chDecommissionEnv string = "CAP_DECOMMISSION_MISSING_CLUSTERHOSTS"
+	chQuietPeriodEnv  string = "CAP_CLUSTERHOST_SNAPSHOT_QUIET_PERIOD"
+	chCreateWaitEnv   string = "CAP_CLUSTERHOST_CREATE_TIMEOUT"
+	adminTokenEnv     string = "CAP_ADMIN_TOKEN"
+	inventoryTTLEnv   string = "CAP_INVENTORY_TTL"
+	pageSizeEnv       string = "CAP_OPAAS_PAGE_SIZE"
+	pageSizesEnv      string = "CAP_OPAAS_PAGE_SIZES"
+	maxPagesEnv       string = "CAP_OPAAS_MAX_PAGES"
+	opaasTimeoutEnv   string = "CAP_OPAAS_TIMEOUT"
+	opaasRetriesEnv   string = "CAP_OPAAS_MAX_RETRIES"
+	opaasCABundleEnv  string = "CAP_OPAAS_CA_BUNDLE"
+	opaasCertEnv      string = "CAP_OPAAS_CLIENT_CERT"
+	opaasKeyFileEnv   string = "CAP_OPAAS_CLIENT_KEY"
+	opaasInsecureEnv  string = "CAP_OPAAS_INSECURE_SKIP_VERIFY"
+	patchParallelEnv  string = "CAP_OPAAS_PATCH_CONCURRENCY"
+	slURLEnv          string = "CAP_SOFTLAYER_URL"
+	slUsernameEnv     string = "CAP_SOFTLAYER_USERNAME"
+	slAPIKeyEnv       string = "CAP_SOFTLAYER_API_KEY"
+	slPageSizeEnv     string = "CAP_SOFTLAYER_PAGE_SIZE"
+	slTimeoutEnv      string = "CAP_SOFTLAYER_TIMEOUT"
+	slCacheTTLEnv     string = "CAP_SOFTLAYER_TTL"
+	aliasFileEnv      string = "CAP_ALIAS_FILE"
+	aliasWatchEnv     string = "CAP_ALIAS_WATCH"
+	vaultAddressEnv   string = "CAP_VAULT_ADDR"
+	vaultTokenEnv     string = "CAP_VAULT_TOKEN"
+	vaultPathEnv      string = "CAP_VAULT_SECRET_PATH"
+	vaultRefreshEnv   string = "CAP_VAULT_REFRESH"
+)
+
+const (
+	UnknownStreamDrop       string = "drop"
+	UnknownStreamDeadLetter string = "dead-letter"
+	UnknownStreamArchive    string = "archive"
 )
 
 type GlobalHook struct {
@@ -29,6 +79,33 @@ type KafkaConfig struct {
 	Password string   `json:"password"`
 	Topic    string   `json:"topic"`
 	Brokers  []string `json:"brokers"`
+	GroupID  string   `json:"groupId"`
+	DLQTopic string   `json:"dlqTopic"`
+}
+
+type BatchConfig struct {
+	Size            int           `json:"size"`
+	Window          time.Duration `json:"window"`
+	RetryBackoffMin time.Duration `json:"retryBackoffMin"`
+	RetryBackoffMax time.Duration `json:"retryBackoffMax"`
+}
+
+type OpaasHTTPConfig struct {
+	Timeout            time.Duration `json:"timeout"`
+	MaxRetries         int           `json:"maxRetries"`
+	CABundle           string        `json:"caBundle"`
+	ClientCert         string        `json:"clientCert"`
+	ClientKey          string        `json:"clientKey"`
+	InsecureSkipVerify bool          `json:"insecureSkipVerify"`
+}
+
+type SoftLayerConfig struct {
+	BaseURL  string        `json:"baseUrl"`
+	Username string        `json:"username"`
+	APIKey   string        `json:"apiKey"`
+	PageSize int           `json:"pageSize"`
+	Timeout  time.Duration `json:"timeout"`
+	CacheTTL time.Duration `json:"cacheTTL"`
 }
 
 type SlackConfig struct {
@@ -37,49 +114,155 @@ type SlackConfig struct {
 }
 
 func GetKafkaConfig() *KafkaConfig {
-	return &KafkaConfig{
-		Username: viper.GetString(kafkaUsernameEnv),
-		Password: viper.GetString(kafkaPasswordEnv),
-		Topic:    viper.GetString(kafkaTopicEnv),
-		Brokers:  viper.GetStringSlice(kafkaBrokersEnv),
-	}
+	kafkaConfig := loadedConfig().Kafka
+	kafkaConfig.Password = currentSecret(kafkaPasswordEnv)
+	return &kafkaConfig
 }
 
-func GetSlackConfig() *SlackConfig {
-	return &SlackConfig{
-		Token:     viper.GetString(slackTokenEnv),
-		ChannelID: viper.GetString(slackChannelIdEnv),
-	}
+func GetKafkaPassword() string {
+	return currentSecret(kafkaPasswordEnv)
 }
 
-func InitEnv() error {
-	if goDotErr := godotenv.Load(); goDotErr != nil {
-		return goDotErr
-	}
+func GetBatchConfig() *BatchConfig {
+	batchConfig := loadedConfig().Batch
+	return &batchConfig
+}
 
-	requiredEnvVars := []string{
-		slackTokenEnv,
-		slackChannelIdEnv,
-		opaasUrlEnv,
-		opaasKeyEnv,
-		kafkaUsernameEnv,
-		kafkaPasswordEnv,
-		kafkaTopicEnv,
-		kafkaBrokersEnv,
-	}
+func GetShutdownGracePeriod() time.Duration {
+	return loadedConfig().ShutdownGracePeriod
+}
+
+func GetFailureBudget() int {
+	return loadedConfig().FailureBudget
+}
+
+func GetHTTPListenAddress() string {
+	return loadedConfig().HTTPListenAddress
+}
+
+func GetLivenessTimeout() time.Duration {
+	return loadedConfig().LivenessTimeout
+}
+
+func GetUnknownStreamPolicy() string {
+	return loadedConfig().UnknownStreamPolicy
+}
+
+func GetClusterhostApproval() bool {
+	return loadedConfig().Clusterhosts.Approval
+}
+
+func GetServerIDRemediation() bool {
+	return loadedConfig().Clusterhosts.ServerIDRemediation
+}
+
+func GetMissingClusterhostSnapshots() int {
+	return loadedConfig().Clusterhosts.MissingSnapshots
+}
+
+func GetDecommissionMissingClusterhosts() bool {
+	return loadedConfig().Clusterhosts.DecommissionMissing
+}
+
+func GetClusterhostSnapshotQuietPeriod() time.Duration {
+	return loadedConfig().Clusterhosts.SnapshotQuietPeriod
+}
 
-	for _, envVar := range requiredEnvVars {
-		bindErr := viper.BindEnv(envVar)
-		if bindErr != nil {
-			return bindErr
+func GetClusterhostCreateTimeout() time.Duration {
+	return loadedConfig().Clusterhosts.CreateTimeout
+}
+
+// GetAdminToken returns the bearer token the /clusterhosts endpoints require,
+// or "" if none is set and the endpoints are disabled.
+func GetAdminToken() string {
+	return currentSecret(adminTokenEnv)
+}
+
+func GetInventoryTTL() time.Duration {
+	return loadedConfig().InventoryTTL
+}
+
+func GetSoftLayerTTL() time.Duration {
+	return loadedConfig().SoftLayer.CacheTTL
+}
+
+func GetOpaasPageSize() int {
+	return loadedConfig().Opaas.PageSize
+}
+
+// GetOpaasPageSizes returns the page size overrides from
+// CAP_OPAAS_PAGE_SIZES, e.g. "instances=500,cluster-hosts=200".
+func GetOpaasPageSizes() map[string]int {
+	return loadedConfig().Opaas.PageSizes
+}
+
+func GetOpaasMaxPages() int {
+	return loadedConfig().Opaas.MaxPages
+}
+
+func parsePageSizes(value string) (map[string]int, error) {
+	pageSizes := make(map[string]int)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s entry %q is not endpoint=size", pageSizesEnv, entry)
 		}
-		if !viper.IsSet(envVar) {
-			errMsg := fmt.Sprintf("%s env variable is not set", envVar)
-			return errors.New(errMsg)
+		pageSize, atoiErr := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if atoiErr != nil || pageSize < 0 {
+			return nil, fmt.Errorf("%s entry %q has an invalid page size", pageSizesEnv, entry)
 		}
+		pageSizes[strings.TrimSpace(parts[0])] = pageSize
 	}
+	return pageSizes, nil
+}
 
-	return nil
+func GetOpaasHTTPConfig() *OpaasHTTPConfig {
+	httpConfig := loadedConfig().Opaas.HTTP
+	return &httpConfig
+}
+
+func GetOpaasConfig() *OpaasConfig {
+	opaasConfig := loadedConfig().Opaas
+	opaasConfig.APIKey = currentSecret(opaasKeyEnv)
+	return &opaasConfig
+}
+
+// GetOpaasAPIKey is read for every request, so a rotated key is used as soon
+// as it is provided.
+func GetOpaasAPIKey() string {
+	return currentSecret(opaasKeyEnv)
+}
+
+func GetPatchConcurrency() int {
+	return loadedConfig().Opaas.PatchConcurrency
+}
+
+func GetSoftLayerConfig() *SoftLayerConfig {
+	softLayerConfig := loadedConfig().SoftLayer
+	softLayerConfig.APIKey = currentSecret(slAPIKeyEnv)
+	return &softLayerConfig
+}
+
+func GetSoftLayerAPIKey() string {
+	return currentSecret(slAPIKeyEnv)
+}
+
+func GetAliasFile() string {
+	return loadedConfig().Aliases.File
+}
+
+func GetAliasWatch() bool {
+	return loadedConfig().Aliases.Watch
+}
+
+func GetSlackConfig() *SlackConfig {
+	slackConfig := loadedConfig().Slack
+	slackConfig.Token = currentSecret(slackTokenEnv)
+	return &slackConfig
 }
 
 func InitLogger() {
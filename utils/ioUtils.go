@@ -6,11 +6,10 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
 )
 
-var OFFSET_FILE string = "output/capacityOffset.json"
-
 type CSVInfo interface {
 	getKeys() []string
 	getValues() []string
@@ -55,74 +54,88 @@ func (c ClusterCSVInfo) getValues() []string {
 	}
 }
 
-type offsetFile struct {
-	Offset int64 `json:"offset"`
-}
-
-func WriteOffset(offset int64) error {
-	offsetFile := offsetFile{
-		Offset: offset,
+func WriteToCSV(filename string, info []CSVInfo) error {
+	if len(info) == 0 {
+		return nil
 	}
 
-	file, createErr := os.Create(OFFSET_FILE)
-	if createErr != nil {
-		return createErr
-	}
-	defer file.Close()
+	file, wasCreated, fileErr := createOrOpenFile(filename)
 
-	jsonToWrite, marshalErr := json.Marshal(offsetFile)
-	if marshalErr != nil {
-		return marshalErr
+	if fileErr != nil {
+		return fileErr
 	}
 
-	_, writeErr := file.Write(jsonToWrite)
-	return writeErr
-}
+	defer file.Close()
 
-func ReadOffset() (int64, error) {
-	if _, err := os.Stat(OFFSET_FILE); os.IsNotExist(err) {
-		writeErr := WriteOffset(0)
-		if writeErr != nil {
-			return -1, writeErr
-		}
-		return 0, nil
-	}
+	csvWriter := csv.NewWriter(file)
 
-	file, readErr := ioutil.ReadFile(OFFSET_FILE)
-	if readErr != nil {
-		return -1, readErr
+	if wasCreated {
+		csvWriter.Write(info[0].getKeys())
 	}
 
-	offsetFile := offsetFile{}
-	unmarshalErr := json.Unmarshal([]byte(file), &offsetFile)
-	if unmarshalErr != nil {
-		return -1, unmarshalErr
+	for _, record := range info {
+		csvWriter.Write(record.getValues())
 	}
 
-	return offsetFile.Offset, nil
+	csvWriter.Flush()
+	return csvWriter.Error()
 }
 
-func WriteToCSV(filename string, info []CSVInfo) error {
-	file, wasCreated, fileErr := createOrOpenFile(filename)
+func AppendJSONLine(filename string, record interface{}) error {
+	jsonLine, marshalErr := json.Marshal(record)
+	if marshalErr != nil {
+		return marshalErr
+	}
 
+	file, _, fileErr := createOrOpenFile(filename)
 	if fileErr != nil {
 		return fileErr
 	}
-
 	defer file.Close()
 
-	csvWriter := csv.NewWriter(file)
-	defer csvWriter.Flush()
+	_, writeErr := file.Write(append(jsonLine, '\n'))
+	return writeErr
+}
 
-	if wasCreated {
-		csvWriter.Write(info[0].getKeys())
+// WriteFileAtomic replaces filename with data by writing a temporary file in
+// the same directory, syncing it and renaming it over the original. A crash
+// or a forced exit leaves either the old file or the new one, never a
+// truncated one.
+func WriteFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	tempFile, createErr := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+"-")
+	if createErr != nil {
+		return createErr
 	}
-
-	for _, record := range info {
-		csvWriter.Write(record.getValues())
+	tempName := tempFile.Name()
+	_, writeErr := tempFile.Write(data)
+	if writeErr == nil {
+		writeErr = tempFile.Sync()
+	}
+	closeErr := tempFile.Close()
+	if writeErr == nil {
+		writeErr = closeErr
+	}
+	if writeErr == nil {
+		writeErr = os.Chmod(tempName, perm)
 	}
+	if writeErr == nil {
+		writeErr = os.Rename(tempName, filename)
+	}
+	if writeErr != nil {
+		os.Remove(tempName)
+		return writeErr
+	}
+	return syncDir(filepath.Dir(filename))
+}
 
-	return nil
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	dirFile, openErr := os.Open(dir)
+	if openErr != nil {
+		return openErr
+	}
+	defer dirFile.Close()
+	return dirFile.Sync()
 }
 
 func createOrOpenFile(filename string) (*os.File, bool, error) {
@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"strconv"
+	"time"
+)
+
+type MissingClusterhostCSV struct {
+	Hostname            string `json:"hostName"`
+	ClusterhostId       string `json:"clusterhostId"`
+	ServerId            string `json:"serverId"`
+	ClusterId           string `json:"clusterId"`
+	FirstMissedSnapshot int    `json:"firstMissedSnapshot"`
+	MissedSnapshots     int    `json:"missedSnapshots"`
+	Decommissioned      bool   `json:"decommissioned"`
+}
+
+func (missingClusterhostCSV MissingClusterhostCSV) getKeys() []string {
+	return []string{
+		"Hostname",
+		"ClusterhostId",
+		"ServerId",
+		"ClusterId",
+		"FirstMissedSnapshot",
+		"MissedSnapshots",
+		"Decommissioned",
+		"Timestamp",
+	}
+}
+
+func (missingClusterhostCSV MissingClusterhostCSV) getValues() []string {
+	return []string{
+		missingClusterhostCSV.Hostname,
+		missingClusterhostCSV.ClusterhostId,
+		missingClusterhostCSV.ServerId,
+		missingClusterhostCSV.ClusterId,
+		customItoa(missingClusterhostCSV.FirstMissedSnapshot),
+		customItoa(missingClusterhostCSV.MissedSnapshots),
+		strconv.FormatBool(missingClusterhostCSV.Decommissioned),
+		time.Now().String(),
+	}
+}
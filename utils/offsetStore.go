@@ -0,0 +1,139 @@
+package utils
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var (
+	OFFSET_FILE             string = "output/capacityOffset.json"
+	DEAD_LETTER_OFFSET_FILE string = "output/deadLetterOffset.json"
+)
+
+// OffsetStore keeps the last processed offset of every partition of a topic
+// for readers that are not part of a consumer group. SetOffset only records
+// the offset in memory; Flush saves every offset set since the last Flush.
+type OffsetStore interface {
+	ReadOffsets(topic string) (map[int]int64, error)
+	SetOffset(topic string, partition int, offset int64) error
+	Flush() error
+	CheckWritable() error
+}
+
+type offsetFile struct {
+	Offset  *int64                   `json:"offset,omitempty"`
+	Offsets map[string]map[int]int64 `json:"offsets"`
+}
+
+type FileOffsetStore struct {
+	filename string
+	offsets  map[string]map[int]int64
+	changed  bool
+}
+
+func NewOffsetStore() OffsetStore {
+	return NewFileOffsetStore(OFFSET_FILE)
+}
+
+func NewFileOffsetStore(filename string) *FileOffsetStore {
+	return &FileOffsetStore{
+		filename: filename,
+	}
+}
+
+func (store *FileOffsetStore) ReadOffsets(topic string) (map[int]int64, error) {
+	if store.offsets == nil {
+		loadErr := store.load(topic)
+		if loadErr != nil {
+			return nil, loadErr
+		}
+	}
+	topicOffsets := map[int]int64{}
+	for partition, offset := range store.offsets[topic] {
+		topicOffsets[partition] = offset
+	}
+	return topicOffsets, nil
+}
+
+func (store *FileOffsetStore) SetOffset(topic string, partition int, offset int64) error {
+	if store.offsets == nil {
+		loadErr := store.load(topic)
+		if loadErr != nil {
+			return loadErr
+		}
+	}
+	if store.offsets[topic] == nil {
+		store.offsets[topic] = map[int]int64{}
+	}
+	store.offsets[topic][partition] = offset
+	store.changed = true
+	return nil
+}
+
+// Flush writes the file once for a whole batch rather than once per message,
+// since every write is synced to disk.
+func (store *FileOffsetStore) Flush() error {
+	if !store.changed {
+		return nil
+	}
+	saveErr := store.save()
+	if saveErr != nil {
+		return saveErr
+	}
+	store.changed = false
+	return nil
+}
+
+func (store *FileOffsetStore) CheckWritable() error {
+	checkFile, createErr := ioutil.TempFile(filepath.Dir(store.filename), ".offset-check-")
+	if createErr != nil {
+		return createErr
+	}
+	checkFile.Close()
+	return os.Remove(checkFile.Name())
+}
+
+func (store *FileOffsetStore) load(topic string) error {
+	store.offsets = map[string]map[int]int64{}
+	if _, err := os.Stat(store.filename); os.IsNotExist(err) {
+		return nil
+	}
+
+	file, readErr := ioutil.ReadFile(store.filename)
+	if readErr != nil {
+		return readErr
+	}
+
+	offsetFile := offsetFile{}
+	unmarshalErr := json.Unmarshal(file, &offsetFile)
+	if unmarshalErr != nil {
+		return unmarshalErr
+	}
+
+	if offsetFile.Offsets != nil {
+		store.offsets = offsetFile.Offsets
+	}
+	// Files written before offsets were tracked per partition hold a single
+	// offset for partition 0 of the configured topic.
+	if offsetFile.Offset != nil && store.offsets[topic] == nil {
+		store.offsets[topic] = map[int]int64{0: *offsetFile.Offset}
+	}
+	return nil
+}
+
+// save never leaves a partly written file behind, since every partition's
+// offset is in it and an unreadable file stops the consumer for good.
+func (store *FileOffsetStore) save() error {
+	offsetFile := offsetFile{
+		Offsets: store.offsets,
+	}
+
+	jsonToWrite, marshalErr := json.Marshal(offsetFile)
+	if marshalErr != nil {
+		return marshalErr
+	}
+
+	return WriteFileAtomic(store.filename, jsonToWrite, 0644)
+}
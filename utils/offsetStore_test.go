@@ -0,0 +1,126 @@
+package utils
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const test_topic string = "capacity"
+
+func TestFileOffsetStoreReadsLegacyFiles(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		want     map[int]int64
+		wantErr  bool
+	}{
+		{
+			name: "missing file",
+			want: map[int]int64{},
+		},
+		{
+			name:     "legacy single offset",
+			contents: `{"offset":42}`,
+			want:     map[int]int64{0: 42},
+		},
+		{
+			name:     "legacy offset zero",
+			contents: `{"offset":0}`,
+			want:     map[int]int64{0: 0},
+		},
+		{
+			name:     "per partition offsets",
+			contents: `{"offsets":{"capacity":{"0":7,"1":9}}}`,
+			want:     map[int]int64{0: 7, 1: 9},
+		},
+		{
+			name:     "per partition offsets win over the legacy offset",
+			contents: `{"offset":42,"offsets":{"capacity":{"1":9}}}`,
+			want:     map[int]int64{1: 9},
+		},
+		{
+			name:     "legacy offset fills a topic without offsets",
+			contents: `{"offset":42,"offsets":{"other":{"0":3}}}`,
+			want:     map[int]int64{0: 42},
+		},
+		{
+			name:     "corrupt file",
+			contents: `{"offsets":`,
+			wantErr:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filename, cleanup := writeTestOffsetFile(t, test.contents)
+			defer cleanup()
+			store := &FileOffsetStore{filename: filename}
+			offsets, readErr := store.ReadOffsets(test_topic)
+			if (readErr != nil) != test.wantErr {
+				t.Fatalf("ReadOffsets() error = %v, wantErr %v", readErr, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(offsets, test.want) {
+				t.Errorf("ReadOffsets() = %v, want %v", offsets, test.want)
+			}
+		})
+	}
+}
+
+func TestFileOffsetStoreUpgradesLegacyFile(t *testing.T) {
+	filename, cleanup := writeTestOffsetFile(t, `{"offset":42}`)
+	defer cleanup()
+	store := &FileOffsetStore{filename: filename}
+	setErr := store.SetOffset(test_topic, 1, 5)
+	if setErr != nil {
+		t.Fatalf("SetOffset() error = %v", setErr)
+	}
+	data, readErr := ioutil.ReadFile(filename)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	if string(data) != `{"offset":42}` {
+		t.Errorf("SetOffset() wrote the file before Flush: %s", data)
+	}
+	flushErr := store.Flush()
+	if flushErr != nil {
+		t.Fatalf("Flush() error = %v", flushErr)
+	}
+	data, readErr = ioutil.ReadFile(filename)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	written := offsetFile{}
+	unmarshalErr := json.Unmarshal(data, &written)
+	if unmarshalErr != nil {
+		t.Fatal(unmarshalErr)
+	}
+	if written.Offset != nil {
+		t.Errorf("upgraded file still holds the legacy offset %d", *written.Offset)
+	}
+	want := map[string]map[int]int64{test_topic: {0: 42, 1: 5}}
+	if !reflect.DeepEqual(written.Offsets, want) {
+		t.Errorf("upgraded offsets = %v, want %v", written.Offsets, want)
+	}
+}
+
+// writeTestOffsetFile returns the path of an offset file with contents, and a
+// function removing its directory. Empty contents leave the file missing.
+func writeTestOffsetFile(t *testing.T, contents string) (string, func()) {
+	dir, dirErr := ioutil.TempDir("", "offsetStore")
+	if dirErr != nil {
+		t.Fatal(dirErr)
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	filename := filepath.Join(dir, "capacityOffset.json")
+	if contents != "" {
+		writeErr := ioutil.WriteFile(filename, []byte(contents), 0644)
+		if writeErr != nil {
+			cleanup()
+			t.Fatal(writeErr)
+		}
+	}
+	return filename, cleanup
+}
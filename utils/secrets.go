@@ -0,0 +1,161 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const secret_file_suffix string = "_FILE"
+
+// SecretProvider is a store secrets are looked up in when neither the
+// setting nor its _FILE variant is set, e.g. Vault. Secret reports found as
+// false for keys the store does not hold.
+type SecretProvider interface {
+	Name() string
+	Secret(key string) (value string, found bool, err error)
+}
+
+// secretSource is where LoadConfig found a secret setting: the value itself
+// or the file named by its _FILE variant.
+type secretSource struct {
+	value string
+	file  string
+}
+
+type cachedSecretFile struct {
+	modTime time.Time
+	size    int64
+	value   string
+}
+
+var (
+	secretMutex     sync.Mutex
+	secretSources   = make(map[string]secretSource)
+	secretProviders []SecretProvider
+	secretFiles     = make(map[string]*cachedSecretFile)
+	lastSecrets     = make(map[string]string)
+)
+
+// RegisterSecretProvider adds a provider that is asked, after the ones
+// already registered, for any secret the configuration does not set.
+func RegisterSecretProvider(provider SecretProvider) {
+	secretMutex.Lock()
+	secretProviders = append(secretProviders, provider)
+	secretMutex.Unlock()
+}
+
+// withSecretFiles adds a KEY_FILE setting for every secret setting.
+func withSecretFiles(settings []setting) []setting {
+	withFiles := []setting{}
+	for _, setting := range settings {
+		withFiles = append(withFiles, setting)
+		if setting.secret {
+			withFiles = append(withFiles, fileSetting(setting))
+		}
+	}
+	return withFiles
+}
+
+func fileSetting(secretSetting setting) setting {
+	return setting{
+		key:   secretSetting.key + secret_file_suffix,
+		usage: "file containing the " + secretSetting.usage,
+	}
+}
+
+func setSecretSources(sources map[string]secretSource) {
+	secretMutex.Lock()
+	secretSources = sources
+	secretMutex.Unlock()
+}
+
+// currentSecret returns the secret as it is now, so a rotated file or
+// provider value is used without a restart. If it cannot be read, the last
+// value that could is returned.
+func currentSecret(key string) string {
+	value, secretErr := readSecret(key)
+	secretMutex.Lock()
+	defer secretMutex.Unlock()
+	if secretErr != nil {
+		logrus.WithFields(logrus.Fields{
+			"secret": key,
+			"Error":  secretErr.Error(),
+		}).Error("Unable to read secret, using the last value read")
+		return lastSecrets[key]
+	}
+	lastSecrets[key] = value
+	return value
+}
+
+func readSecret(key string) (string, error) {
+	value, found, localErr := readLocalSecret(key)
+	if localErr != nil || found {
+		return value, localErr
+	}
+	secretMutex.Lock()
+	providers := secretProviders
+	secretMutex.Unlock()
+	for _, provider := range providers {
+		value, found, providerErr := provider.Secret(key)
+		if providerErr != nil {
+			return "", fmt.Errorf("%s: %w", provider.Name(), providerErr)
+		}
+		if found {
+			return value, nil
+		}
+	}
+	return "", nil
+}
+
+// readLocalSecret reads a secret from the configuration alone, without
+// asking the providers.
+func readLocalSecret(key string) (string, bool, error) {
+	secretMutex.Lock()
+	source := secretSources[key]
+	secretMutex.Unlock()
+	if source.value != "" {
+		return source.value, true, nil
+	}
+	if source.file != "" {
+		value, fileErr := readSecretFile(key, source.file)
+		return value, fileErr == nil, fileErr
+	}
+	return "", false, nil
+}
+
+// readSecretFile only reads the file again when its modification time or
+// size changed. Surrounding whitespace, such as a trailing newline, is
+// dropped.
+func readSecretFile(key string, path string) (string, error) {
+	info, statErr := os.Stat(path)
+	if statErr != nil {
+		return "", fmt.Errorf("Unable to read %s%s: %w", key, secret_file_suffix, statErr)
+	}
+	secretMutex.Lock()
+	cached, isCached := secretFiles[path]
+	secretMutex.Unlock()
+	if isCached && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.value, nil
+	}
+	data, readErr := ioutil.ReadFile(path)
+	if readErr != nil {
+		return "", fmt.Errorf("Unable to read %s%s: %w", key, secret_file_suffix, readErr)
+	}
+	value := strings.TrimSpace(string(data))
+	secretMutex.Lock()
+	secretFiles[path] = &cachedSecretFile{modTime: info.ModTime(), size: info.Size(), value: value}
+	secretMutex.Unlock()
+	if isCached && cached.value != value {
+		logrus.WithFields(logrus.Fields{
+			"secret": key,
+			"file":   path,
+		}).Info("Secret file changed, using the new value")
+	}
+	return value, nil
+}
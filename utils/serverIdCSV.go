@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"time"
+)
+
+type ServerIdChangeCSV struct {
+	Hostname      string `json:"hostName"`
+	ClusterhostId string `json:"clusterhostId"`
+	OldServerId   string `json:"oldServerId"`
+	NewServerId   string `json:"newServerId"`
+	Result        string `json:"result"`
+}
+
+func (serverIdChangeCSV ServerIdChangeCSV) getKeys() []string {
+	return []string{
+		"Hostname",
+		"ClusterhostId",
+		"OldServerId",
+		"NewServerId",
+		"Result",
+		"Timestamp",
+	}
+}
+
+func (serverIdChangeCSV ServerIdChangeCSV) getValues() []string {
+	return []string{
+		serverIdChangeCSV.Hostname,
+		serverIdChangeCSV.ClusterhostId,
+		serverIdChangeCSV.OldServerId,
+		serverIdChangeCSV.NewServerId,
+		serverIdChangeCSV.Result,
+		time.Now().String(),
+	}
+}
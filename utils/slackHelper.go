@@ -2,12 +2,20 @@ package utils
 
 import (
 	"fmt"
+	"github.com/opaas/capacity-worker/metrics"
+	"github.com/sirupsen/logrus"
 	"github.com/slack-go/slack"
 )
 
 const (
-	newClusterHost string = "Attention! New Clusterhost Created"
-	changedServerId string = "Attention! Clusterhost Has a new ServerID"
+	newClusterHost     string = "Attention! New Clusterhost Created"
+	pendingClusterHost string = "Attention! New Clusterhost Awaiting Approval"
+	changedServerId    string = "Attention! Clusterhost Has a new ServerID"
+	updatedServerId    string = "Clusterhost ServerID Updated Automatically"
+	missingClusterHost string = "Attention! Clusterhost Missing From vCenter"
+	decomClusterHost   string = "Clusterhost Missing From vCenter Was Decommissioned"
+	datacenterMismatch string = "Attention! Clusterhost Datacenter Differs From SoftLayer"
+	hardwareMismatch   string = "Attention! Clusterhost Hardware Does Not Match Profile"
 )
 
 var (
@@ -41,43 +49,75 @@ type SlackCHParams struct {
 	WorkloadTypes []string `json:"workloadTypes"`
 	ClusterId     string   `json:"clusterId"`
 	Profile       string   `json:"profile"`
+	MissedCount   int      `json:"missedCount"`
+	Expected      string   `json:"expected"`
+	Actual        string   `json:"actual"`
 }
 
-// TODO: Add logrus logging and error handling
 func SendSlackMessage(slackParams *SlackParams) {
 	blocks := constructSlackBlocks(slackParams)
-	slackConfig := GetSlackConfig()
-	api := slack.New(slackConfig.Token)
-	_, _, err := api.PostMessage(slackConfig.ChannelID, slack.MsgOptionBlocks(blocks...))
-	if err != nil {
-		fmt.Printf("%s\n", err)
-		return
-	}
+	postSlackMessage("cluster", blocks)
 }
 
 func SendAddClusterHostSlackMessage(slackCHParams *SlackCHParams) {
 	blocks := constructCHSlackBlocks(slackCHParams, newClusterHost)
-	slackConfig := GetSlackConfig()
-	api := slack.New(slackConfig.Token)
-	_, _, err := api.PostMessage(slackConfig.ChannelID, slack.MsgOptionBlocks(blocks...))
-	if err != nil {
-		fmt.Printf("%s\n", err)
-		return
-	}
+	postSlackMessage("new_clusterhost", blocks)
+}
+
+func SendPendingClusterHostSlackMessage(slackCHParams *SlackCHParams) {
+	blocks := constructCHSlackBlocks(slackCHParams, pendingClusterHost)
+	postSlackMessage("pending_clusterhost", blocks)
 }
 
 func SendNewServerIdSlackMessage(slackCHParams *SlackCHParams) {
 	blocks := constructCHSlackBlocks(slackCHParams, changedServerId)
+	postSlackMessage("changed_server_id", blocks)
+}
+
+func SendServerIdUpdatedSlackMessage(slackCHParams *SlackCHParams) {
+	blocks := constructCHSlackBlocks(slackCHParams, updatedServerId)
+	postSlackMessage("updated_server_id", blocks)
+}
+
+func SendMissingClusterHostSlackMessage(slackCHParams *SlackCHParams, decommissioned bool) {
+	title := missingClusterHost
+	if decommissioned {
+		title = decomClusterHost
+	}
+	blocks := constructCHSlackBlocks(slackCHParams, title)
+	postSlackMessage("missing_clusterhost", blocks)
+}
+
+func SendDatacenterMismatchSlackMessage(slackCHParams *SlackCHParams) {
+	blocks := constructCHSlackBlocks(slackCHParams, datacenterMismatch)
+	postSlackMessage("datacenter_mismatch", blocks)
+}
+
+func SendHardwareMismatchSlackMessage(slackCHParams *SlackCHParams) {
+	blocks := constructCHSlackBlocks(slackCHParams, hardwareMismatch)
+	postSlackMessage("hardware_mismatch", blocks)
+}
+
+func postSlackMessage(kind string, blocks []slack.Block) {
+	if IsDryRun() {
+		logrus.WithFields(logrus.Fields{
+			"kind": kind,
+		}).Info("Dry run, not sending slack message")
+		metrics.SlackMessages.WithLabelValues(kind, "suppressed").Inc()
+		return
+	}
 	slackConfig := GetSlackConfig()
 	api := slack.New(slackConfig.Token)
 	_, _, err := api.PostMessage(slackConfig.ChannelID, slack.MsgOptionBlocks(blocks...))
+	metrics.SlackMessages.WithLabelValues(kind, metrics.Result(err)).Inc()
 	if err != nil {
-		fmt.Printf("%s\n", err)
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"kind": kind,
+		}).Error("Failed to post slack message")
 		return
 	}
 }
 
-
 func constructSlackBlocks(slackParams *SlackParams) []slack.Block {
 	headerBlock := constructHeaderBlock(slackParams)
 	locationBlock := constructLocationBlock(slackParams)
@@ -119,10 +159,10 @@ func constructFieldsBlock(slackParams *SlackParams) *slack.SectionBlock {
 }
 
 func constructCHSlackBlocks(slackCHParams *SlackCHParams, title string) []slack.Block {
-	if title == newClusterHost {
-		ncHeaderBlock := constructCHHeaderBlock(slackCHParams, newClusterHost)
+	if title == newClusterHost || title == pendingClusterHost {
+		ncHeaderBlock := constructCHHeaderBlock(slackCHParams, title)
 		ncHostnameBlock := constructCHNameBlock(slackCHParams)
-		ncFieldsBlock := constructCHFieldsBlock(slackCHParams, newClusterHost)
+		ncFieldsBlock := constructCHFieldsBlock(slackCHParams, title)
 		ncWorkloadBlock := constructCHWorkloadBlock(slackCHParams)
 		ncDividerBlock := slack.NewDividerBlock()
 		return []slack.Block{
@@ -133,9 +173,9 @@ func constructCHSlackBlocks(slackCHParams *SlackCHParams, title string) []slack.
 			ncDividerBlock,
 		}
 	} else {
-		headerBlock := constructCHHeaderBlock(slackCHParams, changedServerId)
+		headerBlock := constructCHHeaderBlock(slackCHParams, title)
 		hostnameBlock := constructCHNameBlock(slackCHParams)
-		chFieldsBlock := constructCHFieldsBlock(slackCHParams, changedServerId)
+		chFieldsBlock := constructCHFieldsBlock(slackCHParams, title)
 		dividerBlock := slack.NewDividerBlock()
 		return []slack.Block{
 			headerBlock,
@@ -161,10 +201,18 @@ func constructCHNameBlock(slackCHParams *SlackCHParams) *slack.SectionBlock {
 }
 
 func constructCHFieldsBlock(slackCHParams *SlackCHParams, title string) *slack.SectionBlock {
-	if title == newClusterHost {
+	if title == newClusterHost || title == pendingClusterHost {
 		ncFieldsText := fmt.Sprintf("*ServerID:  %s ClusterID: %s*", slackCHParams.ServerId, slackCHParams.ClusterId)
 		ncFieldsTextBlockObj := slack.NewTextBlockObject("mrkdwn", ncFieldsText, false, false)
 		return slack.NewSectionBlock(ncFieldsTextBlockObj, nil, nil)
+	} else if title == missingClusterHost || title == decomClusterHost {
+		mcFieldsText := fmt.Sprintf("*ServerID:  %s ClusterID: %s    Missing for %d snapshots*", slackCHParams.ServerId, slackCHParams.ClusterId, slackCHParams.MissedCount)
+		mcFieldsTextBlockObj := slack.NewTextBlockObject("mrkdwn", mcFieldsText, false, false)
+		return slack.NewSectionBlock(mcFieldsTextBlockObj, nil, nil)
+	} else if title == datacenterMismatch || title == hardwareMismatch {
+		mmFieldsText := fmt.Sprintf("*ServerID:  %s    Expected: %s    SoftLayer: %s*", slackCHParams.ServerId, slackCHParams.Expected, slackCHParams.Actual)
+		mmFieldsTextBlockObj := slack.NewTextBlockObject("mrkdwn", mmFieldsText, false, false)
+		return slack.NewSectionBlock(mmFieldsTextBlockObj, nil, nil)
 	} else {
 		csFieldsText := fmt.Sprintf("*New ServerID:  %s    Old ServerID: %s*", slackCHParams.ServerId, slackCHParams.OldServerId)
 		csFieldsTextBlockObj := slack.NewTextBlockObject("mrkdwn", csFieldsText, false, false)
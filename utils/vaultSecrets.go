@@ -0,0 +1,167 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	vault_request_timeout time.Duration = 10 * time.Second
+	vault_retry_min       time.Duration = 5 * time.Second
+	vault_retry_max       time.Duration = 5 * time.Minute
+)
+
+var errVaultNotRead = errors.New("Vault secret has not been read yet")
+
+// vaultSecretProvider reads secrets from one Vault KV secret whose keys are
+// setting names, such as OPAAS_APIKEY. Both KV versions are understood. The
+// secret is read again in the background once it is older than the refresh
+// interval. Only one read runs at a time and none holds the mutex, so callers
+// keep getting the last secret read while Vault is slow or down. Failed reads
+// are retried with exponential backoff.
+type vaultSecretProvider struct {
+	address    string
+	path       string
+	refresh    time.Duration
+	httpClient *http.Client
+
+	mutex     sync.Mutex
+	secrets   map[string]string
+	fetchedAt time.Time
+	fetching  bool
+	failures  int
+	retryAt   time.Time
+	fetchErr  error
+}
+
+type vaultResponse struct {
+	Data map[string]interface{} `json:"data"`
+}
+
+func newVaultSecretProvider(address string, path string, refresh time.Duration) *vaultSecretProvider {
+	return &vaultSecretProvider{
+		address:    strings.TrimSuffix(address, "/"),
+		path:       strings.Trim(path, "/"),
+		refresh:    refresh,
+		httpClient: &http.Client{Timeout: vault_request_timeout},
+	}
+}
+
+func (vault *vaultSecretProvider) Name() string {
+	return "vault"
+}
+
+func (vault *vaultSecretProvider) Secret(key string) (string, bool, error) {
+	vault.mutex.Lock()
+	if vault.shouldFetch(time.Now()) {
+		vault.fetching = true
+		if vault.secrets != nil {
+			go vault.fetchInBackground()
+		} else {
+			vault.mutex.Unlock()
+			secrets, fetchErr := vault.fetch()
+			vault.mutex.Lock()
+			vault.recordFetch(secrets, fetchErr)
+		}
+	}
+	secrets, fetchErr := vault.secrets, vault.fetchErr
+	vault.mutex.Unlock()
+	if secrets == nil {
+		if fetchErr == nil {
+			fetchErr = errVaultNotRead
+		}
+		return "", false, fetchErr
+	}
+	value, found := secrets[key]
+	return value, found, nil
+}
+
+// fetchInBackground refreshes secrets that were read before, so the caller
+// that noticed they are stale does not wait for Vault either.
+func (vault *vaultSecretProvider) fetchInBackground() {
+	secrets, fetchErr := vault.fetch()
+	vault.mutex.Lock()
+	vault.recordFetch(secrets, fetchErr)
+	vault.mutex.Unlock()
+}
+
+// shouldFetch must be called with the mutex held.
+func (vault *vaultSecretProvider) shouldFetch(now time.Time) bool {
+	if vault.fetching || now.Before(vault.retryAt) {
+		return false
+	}
+	return vault.secrets == nil || now.Sub(vault.fetchedAt) >= vault.refresh
+}
+
+// recordFetch must be called with the mutex held. A failed read keeps the
+// secrets read before.
+func (vault *vaultSecretProvider) recordFetch(secrets map[string]string, fetchErr error) {
+	vault.fetching = false
+	vault.fetchErr = fetchErr
+	if fetchErr == nil {
+		vault.secrets = secrets
+		vault.fetchedAt = time.Now()
+		vault.failures = 0
+		vault.retryAt = time.Time{}
+		return
+	}
+	vault.failures++
+	backoff := ExponentialBackoff(vault.failures, vault_retry_min, vault_retry_max)
+	vault.retryAt = time.Now().Add(backoff)
+	logrus.WithFields(logrus.Fields{
+		"path":     vault.path,
+		"failures": vault.failures,
+		"retryIn":  backoff.String(),
+		"Error":    fetchErr.Error(),
+	}).Error("Unable to read Vault secret, using the secrets read before")
+}
+
+// fetch authenticates with CAP_VAULT_TOKEN, which is itself read from the
+// configuration or CAP_VAULT_TOKEN_FILE, so a rotated token is picked up too.
+func (vault *vaultSecretProvider) fetch() (map[string]string, error) {
+	token, _, tokenErr := readLocalSecret(vaultTokenEnv)
+	if tokenErr != nil {
+		return nil, tokenErr
+	}
+	request, requestErr := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/v1/%s", vault.address, vault.path), nil)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+	request.Header.Set("X-Vault-Token", token)
+	response, responseErr := vault.httpClient.Do(request)
+	if responseErr != nil {
+		return nil, responseErr
+	}
+	defer response.Body.Close()
+	body, readErr := ioutil.ReadAll(response.Body)
+	if readErr != nil {
+		return nil, readErr
+	}
+	if response.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("Vault returned %d %s for %s", response.StatusCode, http.StatusText(response.StatusCode), vault.path)
+	}
+	secret := vaultResponse{}
+	unmarshalErr := json.Unmarshal(body, &secret)
+	if unmarshalErr != nil {
+		return nil, fmt.Errorf("Unable to parse Vault secret %s: %w", vault.path, unmarshalErr)
+	}
+	data := secret.Data
+	if nested, isVersioned := data["data"].(map[string]interface{}); isVersioned && data["metadata"] != nil {
+		data = nested
+	}
+	secrets := make(map[string]string, len(data))
+	for key, value := range data {
+		if stringValue, isString := value.(string); isString {
+			secrets[key] = stringValue
+		}
+	}
+	return secrets, nil
+}